@@ -11,15 +11,19 @@ import (
 	"math/big"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/shamaton/msgpack/v2"
+	"github.com/gorilla/websocket"
+	"github.com/shamaton/msgpack/v3"
 )
 
+const authProtocolPrefix = "npchat.auth."
+
 type AuthMessage struct {
-	Time      []byte `msgpack:"time"`
-	Sig       []byte `msgpack:"sig"`
-	PublicKey []byte `msgpack:"publicKey"`
+	Time      []byte `msgpack:"time" json:"time"`
+	Sig       []byte `msgpack:"sig" json:"sig"`
+	PublicKey []byte `msgpack:"publicKey" json:"publicKey"`
 }
 
 func getAuthMsgFromHeader(r *http.Request) (AuthMessage, error) {
@@ -40,6 +44,19 @@ func getAuthMsgFromQuery(r *http.Request) (AuthMessage, error) {
 	return decodeAuthMsg(authQuery)
 }
 
+// Auth offered as a subprotocol "npchat.auth.<auth>",
+// keeping it out of URLs & access logs.
+// Returns false if none was offered.
+func getAuthMsgFromProtocol(r *http.Request) (AuthMessage, bool, error) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, authProtocolPrefix) {
+			authMsg, err := decodeAuthMsg(strings.TrimPrefix(protocol, authProtocolPrefix))
+			return authMsg, true, err
+		}
+	}
+	return AuthMessage{}, false, nil
+}
+
 func decodeAuthMsg(authStr string) (AuthMessage, error) {
 	authMsg := AuthMessage{}
 	decoded, err := base64.RawURLEncoding.DecodeString(authStr)
@@ -79,21 +96,37 @@ func verifyAuthMessage(msg *AuthMessage, id []byte) bool {
 		return false
 	}
 
+	return verifySignature(msg.PublicKey, msg.Time, msg.Sig)
+}
+
+// Verify a P-256 ECDSA signature of the SHA-256 of payload,
+// given as r || s, by an uncompressed public key
+func verifySignature(publicKey []byte, payload []byte, sig []byte) bool {
+	if len(publicKey) != 65 || len(sig) == 0 {
+		return false
+	}
+
 	// deserialise public key
 	pubKey := ecdsa.PublicKey{
 		Curve: elliptic.P256(),
-		X:     new(big.Int).SetBytes(msg.PublicKey[1:33]),
-		Y:     new(big.Int).SetBytes(msg.PublicKey[33:]),
+		X:     new(big.Int).SetBytes(publicKey[1:33]),
+		Y:     new(big.Int).SetBytes(publicKey[33:]),
 	}
 
-	// hash Time with SHA-256
-	tH := sha256.New()
-	tH.Write(msg.Time)
-	tHash := tH.Sum(nil)
+	// hash payload with SHA-256
+	h := sha256.New()
+	h.Write(payload)
+	hash := h.Sum(nil)
 
 	// verify signature
-	cL := len(msg.Sig) / 2
-	cSigR := new(big.Int).SetBytes(msg.Sig[:cL])
-	cSigS := new(big.Int).SetBytes(msg.Sig[cL:])
-	return ecdsa.Verify(&pubKey, tHash, cSigR, cSigS)
+	cL := len(sig) / 2
+	cSigR := new(big.Int).SetBytes(sig[:cL])
+	cSigS := new(big.Int).SetBytes(sig[cL:])
+	return ecdsa.Verify(&pubKey, hash, cSigR, cSigS)
+}
+
+// Id of the holder of a public key
+func publicKeyId(publicKey []byte) string {
+	h := sha256.Sum256(publicKey)
+	return base64.RawURLEncoding.EncodeToString(h[:])
 }
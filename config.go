@@ -16,17 +16,61 @@ const defaultMsgTtl = time.Second * time.Duration(432000)   // 5 days
 const defaultUserTtl = time.Second * time.Duration(7776000) // 90 days
 const defaultCleanPeriod = time.Second * time.Duration(300) // 5 minutes
 const defaultDataLenMax = 2048                              // 2MB
+const defaultShareableLenMax = 2048
+const defaultMsgLenMax = 0     // unlimited
+const defaultSlotQuota = 65536 // 64KB
+const defaultBufferSize = 512
+const defaultCompressionThreshold = 1024
+const defaultPingPeriod = time.Second * time.Duration(30)
+const defaultPongWait = time.Second * time.Duration(60)
+const defaultWriteWait = time.Second * time.Duration(10)
+const defaultSendQueueSize = 64
+const defaultAuthTimeout = time.Second * time.Duration(10)
+const defaultKeepAlive = time.Second * time.Duration(30)
+const defaultPollTimeout = time.Second * time.Duration(30)
+const defaultSessionTtl = time.Hour
+const defaultWebhookWorkers = 4
+const defaultWebhookQueueSize = 1024
+const defaultWebhookRetries = 5
+const defaultWebhookBackoff = time.Second
+const defaultWebhookTimeout = time.Second * time.Duration(10)
+const defaultSignalRate = 20
+const defaultSignalBurst = 50
+const defaultSignalLenMax = 8192
+const defaultSchedulePeriod = time.Second
+const defaultScheduleMaxAhead = time.Hour * time.Duration(24*30) // 30 days
+const defaultScheduleMaxPerUser = 100
+const defaultPushWorkers = 4
+const defaultPushQueueSize = 1024
+const defaultPushThrottle = time.Minute
+const defaultPushTtl = time.Second * time.Duration(120)
+const defaultPushUrgency = "normal"
+const defaultPushTopic = "message"
+const defaultVAPIDMode = vapidModeUser
 
 type Config struct {
-	Port        int
-	CertFile    string
-	KeyFile     string
-	MsgTTL      Duration
-	UserTTL     Duration
-	CleanPeriod Duration
-	DataLenMax  int
-	Gobkv       GobkvConfig
-	Turn        TurnConfig
+	Port            int
+	CertFile        string
+	KeyFile         string
+	MsgTTL          Duration
+	UserTTL         Duration
+	CleanPeriod     Duration
+	DataLenMax      int
+	ShareableLenMax int
+	MsgLenMax       int
+	SlotQuota       int
+	SyncContent     bool
+	Gobkv           GobkvConfig
+	Turn            TurnConfig
+	Origins         OriginConfig
+	Limits          LimitConfig
+	WebSocket       WebSocketConfig
+	Fallback        FallbackConfig
+	Session         SessionConfig
+	Webhook         WebhookConfig
+	Signal          SignalConfig
+	Schedule        ScheduleConfig
+	Push            PushConfig
 }
 
 // Correctly unmarshal duration in config file
@@ -62,11 +106,67 @@ func loadConfig() (Config, error) {
 	flag.StringVar(&configFile, "c", envConfigFile, "must be a file path")
 	flag.Parse()
 	cfg := Config{
-		Port:        defaultPort,
-		MsgTTL:      Duration{defaultMsgTtl},
-		UserTTL:     Duration{defaultUserTtl},
-		CleanPeriod: Duration{defaultCleanPeriod},
-		DataLenMax:  defaultDataLenMax,
+		Port:            defaultPort,
+		MsgTTL:          Duration{defaultMsgTtl},
+		UserTTL:         Duration{defaultUserTtl},
+		CleanPeriod:     Duration{defaultCleanPeriod},
+		DataLenMax:      defaultDataLenMax,
+		ShareableLenMax: defaultShareableLenMax,
+		MsgLenMax:       defaultMsgLenMax,
+		SlotQuota:       defaultSlotQuota,
+		SyncContent:     true,
+		Origins: OriginConfig{
+			Allowed:       []string{"*"},
+			AllowNoOrigin: true,
+		},
+		Limits: LimitConfig{
+			UserLimit: userLimitEvict,
+		},
+		WebSocket: WebSocketConfig{
+			ReadBufferSize:       defaultBufferSize,
+			WriteBufferSize:      defaultBufferSize,
+			Compression:          true,
+			CompressionThreshold: defaultCompressionThreshold,
+			PingPeriod:           Duration{defaultPingPeriod},
+			PongWait:             Duration{defaultPongWait},
+			WriteWait:            Duration{defaultWriteWait},
+			SendQueueSize:        defaultSendQueueSize,
+			AuthTimeout:          Duration{defaultAuthTimeout},
+			AllowQueryAuth:       true,
+		},
+		Fallback: FallbackConfig{
+			KeepAlive:   Duration{defaultKeepAlive},
+			PollTimeout: Duration{defaultPollTimeout},
+		},
+		Session: SessionConfig{
+			TTL: Duration{defaultSessionTtl},
+		},
+		Webhook: WebhookConfig{
+			Workers:   defaultWebhookWorkers,
+			QueueSize: defaultWebhookQueueSize,
+			Retries:   defaultWebhookRetries,
+			Backoff:   Duration{defaultWebhookBackoff},
+			Timeout:   Duration{defaultWebhookTimeout},
+		},
+		Signal: SignalConfig{
+			Rate:   defaultSignalRate,
+			Burst:  defaultSignalBurst,
+			LenMax: defaultSignalLenMax,
+		},
+		Schedule: ScheduleConfig{
+			Period:     Duration{defaultSchedulePeriod},
+			MaxAhead:   Duration{defaultScheduleMaxAhead},
+			MaxPerUser: defaultScheduleMaxPerUser,
+		},
+		Push: PushConfig{
+			Workers:   defaultPushWorkers,
+			QueueSize: defaultPushQueueSize,
+			Throttle:  Duration{defaultPushThrottle},
+			TTL:       Duration{defaultPushTtl},
+			Urgency:   defaultPushUrgency,
+			Topic:     defaultPushTopic,
+			VAPIDMode: defaultVAPIDMode,
+		},
 	}
 	if configFile == "" {
 		log.Println("no config file defined, running with defaults")
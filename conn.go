@@ -2,27 +2,43 @@ package main
 
 import (
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
-	"github.com/SherClockHolmes/webpush-go"
 	"github.com/gorilla/websocket"
-	"github.com/shamaton/msgpack/v2"
 )
 
 type Response struct {
-	Message  interface{} `msgpack:"message"`
-	VapidKey interface{} `msgpack:"vapidKey"`
-	Data     []byte      `msgpack:"data"`
-	Err      interface{} `msgpack:"error"`
+	Op        string            `msgpack:"op" json:"op"`
+	Id        uint64            `msgpack:"id" json:"id"`
+	Status    string            `msgpack:"status" json:"status"`
+	Code      string            `msgpack:"code,omitempty" json:"code,omitempty"`
+	Message   interface{}       `msgpack:"message,omitempty" json:"message,omitempty"`
+	VapidKey  interface{}       `msgpack:"vapidKey,omitempty" json:"vapidKey,omitempty"`
+	Data      []byte            `msgpack:"data,omitempty" json:"data,omitempty"`
+	Notify    *NotifySettings   `msgpack:"notify,omitempty" json:"notify,omitempty"`
+	Result    string            `msgpack:"result,omitempty" json:"result,omitempty"`
+	MsgId     string            `msgpack:"msgId,omitempty" json:"msgId,omitempty"`
+	Shareable map[string][]byte `msgpack:"shareable,omitempty" json:"shareable,omitempty"`
+	Counts    *InboxCounts      `msgpack:"counts,omitempty" json:"counts,omitempty"`
+	Version   uint64            `msgpack:"version,omitempty" json:"version,omitempty"`
+	Limit     int               `msgpack:"limit,omitempty" json:"limit,omitempty"`
+	Slot      string            `msgpack:"slot,omitempty" json:"slot,omitempty"`
+	Slots     []SlotInfo        `msgpack:"slots,omitempty" json:"slots,omitempty"`
+	From      string            `msgpack:"from,omitempty" json:"from,omitempty"`
+	Ids       []string          `msgpack:"ids,omitempty" json:"ids,omitempty"`
+	Presence  []Presence        `msgpack:"presence,omitempty" json:"presence,omitempty"`
+	Err       interface{}       `msgpack:"error,omitempty" json:"error,omitempty"`
 }
 
 type Message struct {
-	PushSub       string `msgpack:"sub"`
-	Data          []byte `msgpack:"data"`
-	ShareableData []byte `msgpack:"shareableData"`
+	PushSub       string          `msgpack:"sub" json:"sub"`
+	PushPrefs     *PushPrefs      `msgpack:"pushPrefs" json:"pushPrefs"`
+	Notify        *NotifySettings `msgpack:"notify" json:"notify"`
+	Data          []byte          `msgpack:"data" json:"data"`
+	ShareableData []byte          `msgpack:"shareableData" json:"shareableData"`
 }
 
 func handleConnection(w http.ResponseWriter, r *http.Request, o *Oracle, cfg *Config) {
@@ -34,12 +50,17 @@ func handleConnection(w http.ResponseWriter, r *http.Request, o *Oracle, cfg *Co
 		return
 	}
 
-	authMsg, err := getAuthMsgFromQuery(r)
+	// auth before upgrade, if given in handshake
+	authMsg, authed, err := getAuthMsgFromProtocol(r)
+	if !authed && cfg.WebSocket.AllowQueryAuth && r.URL.Query().Has("auth") {
+		authMsg, err = getAuthMsgFromQuery(r)
+		authed = true
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if !verifyAuthMessage(&authMsg, id) {
+	if authed && !verifyAuthMessage(&authMsg, id) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -50,22 +71,27 @@ func handleConnection(w http.ResponseWriter, r *http.Request, o *Oracle, cfg *Co
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ip := o.limiter.clientIP(r)
+	if err := o.limiter.acquire(ip); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer o.limiter.release(ip)
+
+	sock, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	defer conn.Close()
 
-	conn.SetCloseHandler(func(_ int, _ string) error {
-		user, err := o.getUser(idEnc, false)
-		if err != nil {
-			log.Println(err, idEnc)
-			return err
-		}
-		user.unregisterWebSocket(conn)
-		return nil
-	})
+	// else expect auth as first frame
+	if !authed && !readAuthFrame(sock, id, &cfg.WebSocket) {
+		sock.Close()
+		return
+	}
+
+	conn := newConnection(sock, &cfg.WebSocket)
+	defer conn.close()
 
 	user, err := o.getUser(idEnc, true)
 	if err != nil {
@@ -73,75 +99,139 @@ func handleConnection(w http.ResponseWriter, r *http.Request, o *Oracle, cfg *Co
 		return
 	}
 
-	user.pusher.ensureKey()
+	vapidKey := user.pusher.ensureKey(&cfg.Push)
 
-	data, _ := user.getData(o.kv)
+	data, version, _ := user.getVersionedData(o.kv)
 	resp := Response{
+		Op:       opAuth,
+		Status:   statusOk,
 		Message:  "authed",
-		VapidKey: user.pusher.publicKey,
+		VapidKey: vapidKey,
 		Data:     data,
+		Version:  version,
+		Notify:   user.getNotifySettings(o.kv),
 	}
-	respBin, _ := msgpack.Marshal(resp)
-	err = conn.WriteMessage(websocket.BinaryMessage, respBin)
+	// register before replying, so a rejected client is not told it's authed
+	replied := false
+	err = user.registerWebSocket(conn, &cfg.Limits, func() {
+		replied = conn.writeEnvelope(resp)
+	})
 	if err != nil {
-		log.Println("failed to write auth response", err)
-		conn.Close()
+		conn.closeWithReason(websocket.ClosePolicyViolation, err.Error())
 		return
 	}
-
-	user.registerWebSocket(conn)
-	user.sendUnread(o.kv)
+	defer user.unregisterWebSocket(conn)
+	if !replied {
+		log.Println("failed to write auth response")
+		return
+	}
+	user.sendUnread(o)
 
 	for {
-		msgType, msgBin, err := conn.ReadMessage()
+		msgType, msgBin, err := sock.ReadMessage()
 		if err != nil {
 			log.Println("failed to read message", err)
-			conn.Close()
 			return
 		}
 
-		if msgType != websocket.BinaryMessage {
-			msg, _ := msgpack.Marshal(Response{
-				Message: "send only binary data serialised with msgpack",
+		if msgType != envelopeFrameType(conn.encoding) {
+			conn.writeEnvelopeWait(Response{
+				Status:  statusError,
+				Code:    codeBadRequest,
+				Message: "send envelopes serialised with " + conn.encoding,
 				Err:     "invalid message type",
 			})
-			conn.WriteMessage(websocket.BinaryMessage, msg)
 			return
 		}
 
+		if conn.version == 1 {
+			handleRequestBin(msgBin, user, conn, o)
+			continue
+		}
+
 		var msg Message
-		err = msgpack.Unmarshal(msgBin, &msg)
+		err = decodeEnvelope(msgBin, conn.encoding, &msg)
 		if err != nil {
 			log.Println("failed to unmarshal msg", err)
 			return
 		}
+		handleMessage(&msg, user, conn, o)
+	}
+}
 
-		if msg.PushSub != "" {
-			log.Println("got sub", msg.PushSub)
-			sub := webpush.Subscription{}
-			err := json.Unmarshal([]byte(msg.PushSub), &sub)
-			if err != nil {
-				log.Println("failed to unmarshal push subscription")
-			}
-			user.pusher.addSubscription(&sub)
+// Handle v0 message.
+// Failures are replied as error responses naming the op.
+func handleMessage(msg *Message, user *User, conn *Connection, o *Oracle) {
+	reply := func(op string, err error) {
+		log.Println(op, "failed", err)
+		conn.writeEnvelope(makeResponse(&Request{Op: op}, err))
+	}
+
+	if msg.PushSub != "" {
+		log.Println("got sub", msg.PushSub)
+		err := user.setPushSub(msg.PushSub)
+		if err != nil {
+			reply(opSetSub, err)
 		}
+	}
 
-		if msg.Data != nil && len(msg.Data) <= cfg.DataLenMax {
-			user.setData(msg.Data, o.kv)
+	if msg.PushPrefs != nil {
+		user.pusher.setPrefs(*msg.PushPrefs)
+	}
+
+	if msg.Notify != nil {
+		err := user.setNotifySettings(msg.Notify, o.kv)
+		if err != nil {
+			reply(opSetNotify, newProtocolError(codeBadRequest, err.Error()))
 		}
+	}
 
-		if msg.ShareableData != nil && len(msg.ShareableData) <= cfg.DataLenMax {
-			user.setShareableData(msg.ShareableData, o.kv)
+	if msg.Data != nil {
+		_, _, err := user.writeData(msg.Data, nil, o, nil)
+		if err != nil {
+			reply(opSetData, err)
+		}
+	}
+
+	if msg.ShareableData != nil {
+		_, err := user.writeShareable(msg.ShareableData, o, nil)
+		if err != nil {
+			reply(opSetShareable, err)
 		}
 	}
 }
 
-func checkOrigin(r *http.Request) bool {
+// Read & verify an AuthMessage sent as the first frame,
+// in the negotiated envelope encoding.
+// On failure, an error response is written.
+func readAuthFrame(sock *websocket.Conn, id []byte, cfg *WebSocketConfig) bool {
+	_, encoding := parseSubprotocol(sock.Subprotocol())
+	sock.SetReadDeadline(time.Now().Add(cfg.AuthTimeout.Duration))
+	msgType, authBin, err := sock.ReadMessage()
+	if err != nil {
+		log.Println("failed to read auth frame", err)
+		return false
+	}
+	authMsg := AuthMessage{}
+	if msgType == envelopeFrameType(encoding) {
+		err = decodeEnvelope(authBin, encoding, &authMsg)
+	}
+	if msgType != envelopeFrameType(encoding) || err != nil || !verifyAuthMessage(&authMsg, id) {
+		resp, respType, _ := encodeEnvelope(Response{
+			Op:      opAuth,
+			Status:  statusError,
+			Code:    codeUnauthorized,
+			Message: "unauthorized",
+			Err:     "unauthorized",
+		}, encoding)
+		sock.SetWriteDeadline(time.Now().Add(cfg.WriteWait.Duration))
+		sock.WriteMessage(respType, resp)
+		return false
+	}
 	return true
 }
 
+// CheckOrigin, buffer sizes & compression are set from config in main
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  512,
-	WriteBufferSize: 512,
-	CheckOrigin:     checkOrigin,
+	Subprotocols: subprotocols,
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strconv"
+)
+
+const opChanged = "changed"
+
+// Built-in slot names for the data & shareable blobs,
+// reserved so named slots cannot shadow them
+const slotData = "data"
+const slotShareable = "shareable"
+
+func (u *User) getVersion(slot string, kv *GobkvClient) (uint64, error) {
+	stored, err := kv.get(u.id + "/" + slot + "Version")
+	if err != nil || len(stored) == 0 {
+		return 0, err
+	}
+	return strconv.ParseUint(string(stored), 10, 64)
+}
+
+func (u *User) setVersion(slot string, version uint64, kv *GobkvClient) error {
+	return kv.set(u.id+"/"+slot+"Version", []byte(strconv.FormatUint(version, 10)))
+}
+
+func (u *User) getVersionedData(kv *GobkvClient) ([]byte, uint64, error) {
+	u.dataMux.Lock()
+	defer u.dataMux.Unlock()
+	version, err := u.getVersion(slotData, kv)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := u.getData(kv)
+	return data, version, err
+}
+
+// Write data if expected matches the stored version, or
+// unconditionally if expected is nil. Returns the new version.
+// On conflict, returns the current version & data.
+// Other connections are told of the new version.
+func (u *User) writeData(data []byte, expected *uint64, o *Oracle, from *Connection) (uint64, []byte, error) {
+	if len(data) > o.config.DataLenMax {
+		return 0, nil, newLimitError("data", o.config.DataLenMax)
+	}
+	u.dataMux.Lock()
+	defer u.dataMux.Unlock()
+	version, err := u.getVersion(slotData, o.kv)
+	if err != nil {
+		return 0, nil, err
+	}
+	if expected != nil && *expected != version {
+		current, err := u.getData(o.kv)
+		if err != nil {
+			return 0, nil, err
+		}
+		return version, current, newProtocolError(codeConflict, "stale version %v, current is %v", *expected, version)
+	}
+	err = u.setData(data, o.kv)
+	if err != nil {
+		return 0, nil, err
+	}
+	version++
+	err = u.setVersion(slotData, version, o.kv)
+	if err != nil {
+		return 0, nil, err
+	}
+	u.broadcastChange(slotData, version, data, o, from)
+	return version, nil, nil
+}
+
+// Write shareable unconditionally, returning the new version.
+// Other connections are told of the new version.
+func (u *User) writeShareable(shareableData []byte, o *Oracle, from *Connection) (uint64, error) {
+	if len(shareableData) > o.config.ShareableLenMax {
+		return 0, newLimitError("shareable", o.config.ShareableLenMax)
+	}
+	u.dataMux.Lock()
+	defer u.dataMux.Unlock()
+	version, err := u.getVersion(slotShareable, o.kv)
+	if err != nil {
+		return 0, err
+	}
+	err = u.setShareableData(shareableData, o.kv)
+	if err != nil {
+		return 0, err
+	}
+	version++
+	err = u.setVersion(slotShareable, version, o.kv)
+	if err != nil {
+		return 0, err
+	}
+	u.broadcastChange(slotShareable, version, shareableData, o, from)
+	return version, nil
+}
+
+// Tell other connections that a slot changed,
+// with the content if configured
+func (u *User) broadcastChange(slot string, version uint64, content []byte, o *Oracle, from *Connection) {
+	event := Response{
+		Op:      opChanged,
+		Status:  statusOk,
+		Slot:    slot,
+		Version: version,
+	}
+	if o.config.SyncContent {
+		event.Data = content
+	}
+	u.broadcastEvent(event, from)
+}
+
+// Send event to every v1 connection, except the given one
+func (u *User) broadcastEvent(event Response, except *Connection) {
+	for _, c := range u.connections() {
+		if c != except && c.version == 1 {
+			c.writeEnvelope(event)
+		}
+	}
+}
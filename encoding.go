@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/shamaton/msgpack/v3"
+)
+
+// Encoding of the control envelope (Message, Request & Response),
+// negotiated with a ".json" suffix on the protocol, like "npchat.v1.json".
+// Payloads are always opaque binary frames.
+const encodingMsgpack = "msgpack"
+const encodingJSON = "json"
+
+var subprotocols = []string{
+	protocolV1,
+	protocolV1 + "." + encodingJSON,
+	protocolV0,
+	protocolV0 + "." + encodingJSON,
+}
+
+// Split negotiated subprotocol into version & envelope encoding
+func parseSubprotocol(protocol string) (int, string) {
+	version := 0
+	if strings.HasPrefix(protocol, protocolV1) {
+		version = 1
+	}
+	if strings.HasSuffix(protocol, "."+encodingJSON) {
+		return version, encodingJSON
+	}
+	return version, encodingMsgpack
+}
+
+// Returns encoded envelope & its frame type
+func encodeEnvelope(v interface{}, encoding string) ([]byte, int, error) {
+	if encoding == encodingJSON {
+		encoded, err := json.Marshal(v)
+		return encoded, websocket.TextMessage, err
+	}
+	encoded, err := msgpack.Marshal(v)
+	return encoded, websocket.BinaryMessage, err
+}
+
+func decodeEnvelope(data []byte, encoding string, v interface{}) error {
+	if encoding == encodingJSON {
+		return json.Unmarshal(data, v)
+	}
+	return msgpack.Unmarshal(data, v)
+}
+
+// Frame type clients must use for envelopes
+func envelopeFrameType(encoding string) int {
+	if encoding == encodingJSON {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
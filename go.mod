@@ -1,15 +1,15 @@
 module github.com/dr-useless/go-npchat
 
-go 1.17
+go 1.23
 
 require (
 	github.com/dr-useless/gobkv v0.0.6
 	github.com/SherClockHolmes/webpush-go v1.1.3
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/gorilla/websocket v1.4.2
-	github.com/shamaton/msgpack/v2 v2.1.0
+	github.com/shamaton/msgpack/v3 v3.1.0
 )
 
 require (
-	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
 	golang.org/x/crypto v0.0.0-20220112180741-5e0467b6c7ce // indirect
 )
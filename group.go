@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shamaton/msgpack/v3"
+)
+
+// Group mailboxes, fanning messages out to every member.
+// Membership is changed by operations signed by an admin,
+// each with the next seq, so they can't be replayed.
+//   GET  /group/<groupId>      get membership
+//   POST /group/<groupId>      send message to members
+//   GET  /group/<groupId>/ops  list applied operations
+//   POST /group/<groupId>/ops  apply signed operation
+// The group is stored at group/<groupId>,
+// & each applied operation at group/<groupId>/op/<seq>.
+
+const groupActionCreate = "create"
+const groupActionAdd = "add"
+const groupActionRemove = "remove"
+const groupActionPromote = "promote"
+const groupActionDemote = "demote"
+
+const groupMembersMax = 256
+
+type Group struct {
+	Id      string   `msgpack:"id" json:"id"`
+	Seq     uint64   `msgpack:"seq" json:"seq"`
+	Admins  []string `msgpack:"admins" json:"admins"`
+	Members []string `msgpack:"members" json:"members"`
+}
+
+// Signed by an admin, serialised with msgpack
+type GroupOp struct {
+	Group  string   `msgpack:"group"`
+	Seq    uint64   `msgpack:"seq"`
+	Action string   `msgpack:"action"`
+	Ids    []string `msgpack:"ids"`
+}
+
+type SignedGroupOp struct {
+	Op        []byte `msgpack:"op" json:"op"`
+	Sig       []byte `msgpack:"sig" json:"sig"`
+	PublicKey []byte `msgpack:"publicKey" json:"publicKey"`
+}
+
+// Sent to members when membership changes
+type GroupEvent struct {
+	Type   string   `msgpack:"type"` // always "group"
+	Group  string   `msgpack:"group"`
+	Seq    uint64   `msgpack:"seq"`
+	Action string   `msgpack:"action"`
+	Ids    []string `msgpack:"ids"`
+	By     string   `msgpack:"by"`
+	Time   int64    `msgpack:"time"` // unix ms
+}
+
+// Sent to members for a message POSTed to the group
+type GroupMessage struct {
+	Type  string `msgpack:"type"` // always "groupMessage"
+	Group string `msgpack:"group"`
+	From  string `msgpack:"from"`
+	Body  []byte `msgpack:"body"`
+}
+
+func isGroupPath(path string) bool {
+	return strings.HasPrefix(path, "/group/")
+}
+
+func handleGroup(w http.ResponseWriter, r *http.Request, o *Oracle) {
+	// path is /group/<groupId>[/ops]
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	groupId := ""
+	if len(segments) > 1 {
+		groupId = segments[1]
+	}
+	if !isValidId(groupId) {
+		http.Error(w, fmt.Sprintf("invalid group id %v", groupId), http.StatusBadRequest)
+		return
+	}
+	isOps := len(segments) > 2 && segments[2] == "ops"
+	if isOps && r.Method == "POST" {
+		handlePostGroupOp(w, r, groupId, o)
+		return
+	}
+
+	// other requests are by members
+	senderId, ok := authenticatedSender(r, o.config)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	group, err := getGroup(groupId, o.kv)
+	if err != nil {
+		http.Error(w, "failed to get group", http.StatusInternalServerError)
+		return
+	}
+	if group == nil || !contains(group.Members, senderId) {
+		http.Error(w, "not a member of "+groupId, http.StatusNotFound)
+		return
+	}
+	switch {
+	case isOps && r.Method == "GET":
+		handleListGroupOps(w, group, o)
+	case len(segments) == 2 && r.Method == "GET":
+		resp, _ := json.Marshal(group)
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(resp)
+	case len(segments) == 2 && r.Method == "POST":
+		handlePostGroupMessage(w, r, group, senderId, o)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func handlePostGroupOp(w http.ResponseWriter, r *http.Request, groupId string, o *Oracle) {
+	signed := SignedGroupOp{}
+	err := json.NewDecoder(r.Body).Decode(&signed)
+	if err != nil {
+		http.Error(w, "invalid operation", http.StatusBadRequest)
+		return
+	}
+	group, err := o.applyGroupOp(groupId, &signed)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	resp, _ := json.Marshal(group)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func handleListGroupOps(w http.ResponseWriter, group *Group, o *Oracle) {
+	keys, err := o.kv.list(groupOpPrefix(group.Id))
+	if err != nil {
+		http.Error(w, "failed to list operations", http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(keys)
+	ops := make([]SignedGroupOp, 0, len(keys))
+	for _, key := range keys {
+		opBin, err := o.kv.get(key)
+		if err != nil {
+			http.Error(w, "failed to get operation", http.StatusInternalServerError)
+			return
+		}
+		signed := SignedGroupOp{}
+		if msgpack.Unmarshal(opBin, &signed) == nil {
+			ops = append(ops, signed)
+		}
+	}
+	resp, _ := json.Marshal(ops)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// Fan message out to every member but the sender
+func handlePostGroupMessage(w http.ResponseWriter, r *http.Request, group *Group, senderId string, o *Oracle) {
+	body, err := readMessage(r.Body, o.config)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if err := checkMsgLen(body, o.config); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	msg, _ := msgpack.Marshal(GroupMessage{
+		Type:  "groupMessage",
+		Group: group.Id,
+		From:  senderId,
+		Body:  body,
+	})
+	// sender is given, as it's not in the message's f field,
+	// so members' mutes & hideSender apply
+	from, _ := base64.RawURLEncoding.DecodeString(senderId)
+	d := Delivery{
+		Store: r.URL.Query().Get("store") != "false",
+		From:  from,
+	}
+	for _, memberId := range group.Members {
+		if memberId == senderId {
+			continue
+		}
+		member, err := o.getUser(memberId, true)
+		if err != nil {
+			log.Println("failed to get group member", memberId, err)
+			continue
+		}
+		member.sendMessage(msg, o, d)
+	}
+}
+
+// Verify & apply a signed operation, recording it & notifying members
+func (o *Oracle) applyGroupOp(groupId string, signed *SignedGroupOp) (*Group, error) {
+	op := GroupOp{}
+	err := msgpack.Unmarshal(signed.Op, &op)
+	if err != nil || op.Group != groupId {
+		return nil, newProtocolError(codeBadRequest, "invalid operation")
+	}
+	if !verifySignature(signed.PublicKey, signed.Op, signed.Sig) {
+		return nil, newProtocolError(codeUnauthorized, "invalid signature")
+	}
+	by := publicKeyId(signed.PublicKey)
+
+	o.groupMux.Lock()
+	defer o.groupMux.Unlock()
+	group, err := getGroup(groupId, o.kv)
+	if err != nil {
+		return nil, err
+	}
+	before := []string{}
+	if group != nil {
+		before = group.Members
+	}
+	group, err = group.apply(&op, by)
+	if err != nil {
+		return nil, err
+	}
+
+	groupBin, _ := msgpack.Marshal(group)
+	err = o.kv.set(groupKey(groupId), groupBin)
+	if err != nil {
+		return nil, err
+	}
+	signedBin, _ := msgpack.Marshal(signed)
+	err = o.kv.set(fmt.Sprintf("%s%016x", groupOpPrefix(groupId), group.Seq), signedBin)
+	if err != nil {
+		log.Println("failed to record group operation", err)
+	}
+
+	event, _ := msgpack.Marshal(GroupEvent{
+		Type:   "group",
+		Group:  groupId,
+		Seq:    group.Seq,
+		Action: op.Action,
+		Ids:    op.Ids,
+		By:     by,
+		Time:   time.Now().UnixMilli(),
+	})
+	// removed members are told too
+	for _, memberId := range union(before, group.Members) {
+		member, err := o.getUser(memberId, true)
+		if err != nil {
+			continue
+		}
+		member.sendMessage(event, o, Delivery{
+			Store:  true,
+			Silent: true,
+		})
+	}
+	return group, nil
+}
+
+// Returns the group after op, leaving g unchanged.
+// A nil group can only be created.
+// Any member may remove themselves.
+func (g *Group) apply(op *GroupOp, by string) (*Group, error) {
+	if g == nil {
+		if op.Action != groupActionCreate || op.Seq != 1 {
+			return nil, newProtocolError(codeBadRequest, "no group %v", op.Group)
+		}
+		return checkGroupLimits(&Group{
+			Id:      op.Group,
+			Seq:     1,
+			Admins:  []string{by},
+			Members: union([]string{by}, validIds(op.Ids)),
+		})
+	}
+	if op.Seq != g.Seq+1 {
+		return nil, newProtocolError(codeConflict, "expected seq %v", g.Seq+1)
+	}
+	leaving := op.Action == groupActionRemove && len(op.Ids) == 1 && op.Ids[0] == by
+	if !contains(g.Admins, by) && !(leaving && contains(g.Members, by)) {
+		return nil, newProtocolError(codeUnauthorized, "not an admin of %v", g.Id)
+	}
+	next := &Group{
+		Id:      g.Id,
+		Seq:     op.Seq,
+		Admins:  g.Admins,
+		Members: g.Members,
+	}
+	switch op.Action {
+	case groupActionAdd:
+		next.Members = union(g.Members, validIds(op.Ids))
+	case groupActionRemove:
+		next.Members = without(g.Members, op.Ids)
+		next.Admins = without(g.Admins, op.Ids)
+	case groupActionPromote:
+		next.Admins = union(g.Admins, intersect(op.Ids, g.Members))
+	case groupActionDemote:
+		next.Admins = without(g.Admins, op.Ids)
+	default:
+		return nil, newProtocolError(codeBadRequest, "unknown action %q", op.Action)
+	}
+	if len(next.Admins) == 0 && len(next.Members) > 0 {
+		return nil, newProtocolError(codeConflict, "a group must keep an admin")
+	}
+	return checkGroupLimits(next)
+}
+
+func checkGroupLimits(g *Group) (*Group, error) {
+	if len(g.Members) > groupMembersMax {
+		return nil, newProtocolError(codeTooLarge, "groups have at most %v members", groupMembersMax)
+	}
+	return g, nil
+}
+
+// Returns nil if there is no such group
+func getGroup(groupId string, kv *GobkvClient) (*Group, error) {
+	groupBin, err := kv.get(groupKey(groupId))
+	if err != nil {
+		return nil, err
+	}
+	if len(groupBin) == 0 {
+		return nil, nil
+	}
+	group := Group{}
+	err = msgpack.Unmarshal(groupBin, &group)
+	return &group, err
+}
+
+func groupKey(groupId string) string {
+	return "group/" + groupId
+}
+
+func groupOpPrefix(groupId string) string {
+	return "group/" + groupId + "/op/"
+}
+
+// User & group ids are 32 bytes, base64url encoded
+func isValidId(groupId string) bool {
+	id, err := base64.RawURLEncoding.DecodeString(groupId)
+	return err == nil && len(id) == 32
+}
+
+func validIds(ids []string) []string {
+	valid := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if isValidId(id) {
+			valid = append(valid, id)
+		}
+	}
+	return valid
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func union(a []string, b []string) []string {
+	result := append([]string{}, a...)
+	for _, id := range b {
+		if !contains(result, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func without(a []string, b []string) []string {
+	result := make([]string, 0, len(a))
+	for _, id := range a {
+		if !contains(b, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func intersect(a []string, b []string) []string {
+	result := make([]string, 0, len(a))
+	for _, id := range a {
+		if contains(b, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func testId(b byte) string {
+	id := make([]byte, 32)
+	id[0] = b
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+func expectCode(t *testing.T, err error, code string) {
+	t.Helper()
+	var pErr *ProtocolError
+	if !errors.As(err, &pErr) || pErr.Code != code {
+		t.Errorf("got error %v, want code %v", err, code)
+	}
+}
+
+func createTestGroup(t *testing.T, admin string, ids ...string) *Group {
+	t.Helper()
+	g, err := (*Group)(nil).apply(&GroupOp{
+		Group:  testId(0),
+		Seq:    1,
+		Action: groupActionCreate,
+		Ids:    ids,
+	}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGroupCreate(t *testing.T) {
+	admin, a := testId(1), testId(2)
+	g := createTestGroup(t, admin, a, a, "invalid")
+	if len(g.Admins) != 1 || g.Admins[0] != admin {
+		t.Errorf("got admins %v", g.Admins)
+	}
+	// deduplicated & validated, with the creator
+	if len(g.Members) != 2 || !contains(g.Members, admin) || !contains(g.Members, a) {
+		t.Errorf("got members %v", g.Members)
+	}
+}
+
+func TestGroupCreateNeedsFirstSeq(t *testing.T) {
+	_, err := (*Group)(nil).apply(&GroupOp{Group: testId(0), Seq: 2, Action: groupActionCreate}, testId(1))
+	expectCode(t, err, codeBadRequest)
+	_, err = (*Group)(nil).apply(&GroupOp{Group: testId(0), Seq: 1, Action: groupActionAdd}, testId(1))
+	expectCode(t, err, codeBadRequest)
+}
+
+func TestGroupCreateCapsMembers(t *testing.T) {
+	ids := []string{}
+	for i := 0; i < groupMembersMax; i++ {
+		id := make([]byte, 32)
+		id[0], id[1] = byte(i), byte(i>>8)
+		id[2] = 1
+		ids = append(ids, base64.RawURLEncoding.EncodeToString(id))
+	}
+	_, err := (*Group)(nil).apply(&GroupOp{
+		Group:  testId(0),
+		Seq:    1,
+		Action: groupActionCreate,
+		Ids:    ids,
+	}, testId(1))
+	expectCode(t, err, codeTooLarge)
+}
+
+func TestGroupSeq(t *testing.T) {
+	admin := testId(1)
+	g := createTestGroup(t, admin)
+	for _, seq := range []uint64{1, 3} {
+		_, err := g.apply(&GroupOp{Group: g.Id, Seq: seq, Action: groupActionAdd, Ids: []string{testId(2)}}, admin)
+		expectCode(t, err, codeConflict)
+	}
+}
+
+func TestGroupAdminOps(t *testing.T) {
+	admin, a, b := testId(1), testId(2), testId(3)
+	g := createTestGroup(t, admin, a)
+
+	g, err := g.apply(&GroupOp{Group: g.Id, Seq: 2, Action: groupActionAdd, Ids: []string{b}}, admin)
+	if err != nil || !contains(g.Members, b) {
+		t.Fatalf("add failed: %v %v", err, g)
+	}
+	g, err = g.apply(&GroupOp{Group: g.Id, Seq: 3, Action: groupActionPromote, Ids: []string{a, testId(9)}}, admin)
+	if err != nil || !contains(g.Admins, a) || contains(g.Admins, testId(9)) {
+		t.Fatalf("promote failed: %v %v", err, g)
+	}
+	g, err = g.apply(&GroupOp{Group: g.Id, Seq: 4, Action: groupActionRemove, Ids: []string{admin}}, a)
+	if err != nil || contains(g.Members, admin) || contains(g.Admins, admin) {
+		t.Fatalf("remove failed: %v %v", err, g)
+	}
+	g, err = g.apply(&GroupOp{Group: g.Id, Seq: 5, Action: groupActionDemote, Ids: []string{a}}, a)
+	expectCode(t, err, codeConflict)
+}
+
+func TestGroupMembersCannotManage(t *testing.T) {
+	admin, a, b := testId(1), testId(2), testId(3)
+	g := createTestGroup(t, admin, a, b)
+	_, err := g.apply(&GroupOp{Group: g.Id, Seq: 2, Action: groupActionRemove, Ids: []string{b}}, a)
+	expectCode(t, err, codeUnauthorized)
+	_, err = g.apply(&GroupOp{Group: g.Id, Seq: 2, Action: groupActionAdd, Ids: []string{testId(4)}}, testId(4))
+	expectCode(t, err, codeUnauthorized)
+
+	// but can leave
+	left, err := g.apply(&GroupOp{Group: g.Id, Seq: 2, Action: groupActionRemove, Ids: []string{a}}, a)
+	if err != nil || contains(left.Members, a) {
+		t.Fatalf("leave failed: %v %v", err, left)
+	}
+	// leaving g unchanged
+	if !contains(g.Members, a) || g.Seq != 1 {
+		t.Error("apply changed the original group")
+	}
+}
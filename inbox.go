@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pull API over the same keys as sendUnread.
+// An inbox id is an unread key without the user's unread prefix,
+// "<arrival as hex>.<msgId>", so ids sort in arrival order
+// & after is a stable cursor.
+//   GET    /<id>/inbox?after=<msgId>&limit=<n>  list unread
+//   GET    /<id>/inbox/<msgId>                  get message
+//   POST   /<id>/inbox/ack                      mark ids read
+//   DELETE /<id>/inbox/<msgId>                  delete message
+
+const inboxLimitDefault = 50
+const inboxLimitMax = 500
+
+type InboxMessage struct {
+	Id   string `json:"id"`
+	Data []byte `json:"data"`
+}
+
+type InboxPage struct {
+	Messages []InboxMessage `json:"messages"`
+	Next     string         `json:"next"` // pass as after for the next page
+}
+
+type AckRequest struct {
+	Ids []string `json:"ids"`
+}
+
+func handleInbox(w http.ResponseWriter, r *http.Request, o *Oracle) {
+	idEnc, ok := checkRequestAuth(w, r, o.config)
+	if !ok {
+		return
+	}
+	user, err := o.getUser(idEnc, true)
+	if err != nil {
+		http.Error(w, "failed to get user", http.StatusInternalServerError)
+		return
+	}
+	// path is /<id>/inbox[/<msgId>]
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	msgId := ""
+	if len(segments) > 2 {
+		msgId = segments[2]
+	}
+	switch {
+	case r.Method == "GET" && msgId == "":
+		handleListUnread(w, r, user, o)
+	case r.Method == "GET":
+		handleGetInboxMessage(w, user, msgId, o)
+	case r.Method == "POST" && msgId == "ack":
+		handleAck(w, r, user, o)
+	case r.Method == "DELETE" && msgId != "":
+		user.deleteMessage(msgId, o.kv)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func handleListUnread(w http.ResponseWriter, r *http.Request, user *User, o *Oracle) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = inboxLimitDefault
+	}
+	if limit > inboxLimitMax {
+		limit = inboxLimitMax
+	}
+	keys, err := o.kv.list(user.unreadPrefix())
+	if err != nil {
+		http.Error(w, "failed to list messages", http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(keys)
+	after := r.URL.Query().Get("after")
+	page := InboxPage{
+		Messages: make([]InboxMessage, 0),
+	}
+	for _, key := range keys {
+		msgId := strings.TrimPrefix(key, user.unreadPrefix())
+		if after != "" && msgId <= after {
+			continue
+		}
+		if len(page.Messages) == limit {
+			page.Next = page.Messages[limit-1].Id
+			break
+		}
+		data, err := o.kv.get(key)
+		if err != nil {
+			http.Error(w, "failed to get message", http.StatusInternalServerError)
+			return
+		}
+		page.Messages = append(page.Messages, InboxMessage{
+			Id:   msgId,
+			Data: data,
+		})
+	}
+	resp, _ := json.Marshal(page)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func handleGetInboxMessage(w http.ResponseWriter, user *User, msgId string, o *Oracle) {
+	data, err := o.kv.get(user.messagePrefix() + inboxMessageId(msgId))
+	if err != nil || len(data) == 0 {
+		http.Error(w, "nothing found for id "+msgId, http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+func handleAck(w http.ResponseWriter, r *http.Request, user *User, o *Oracle) {
+	ack := AckRequest{}
+	err := json.NewDecoder(r.Body).Decode(&ack)
+	if err != nil {
+		http.Error(w, "invalid ack", http.StatusBadRequest)
+		return
+	}
+	user.ackMessages(ack.Ids, o)
+}
+
+func (u *User) messagePrefix() string {
+	return u.id + "/m/"
+}
+
+func (u *User) unreadPrefix() string {
+	return u.id + "/m/unread/"
+}
+
+// Unread copy of a message, keyed in arrival order
+func (u *User) unreadKey(msgId string) string {
+	return fmt.Sprintf("%s%016x.%s", u.unreadPrefix(), time.Now().UnixNano(), msgId)
+}
+
+// Message id of an inbox id.
+// Ids stored before arrival ordering are the message id.
+func inboxMessageId(inboxId string) string {
+	return inboxId[strings.LastIndex(inboxId, ".")+1:]
+}
+
+func (u *User) deleteMessage(inboxId string, kv *GobkvClient) {
+	kv.del(u.unreadPrefix() + inboxId)
+	kv.del(u.messagePrefix() + inboxMessageId(inboxId))
+}
@@ -6,14 +6,25 @@ import (
 	"time"
 )
 
-func handleGetInfo(w http.ResponseWriter, startTime *time.Time, cfg *Config) {
+func handleGetInfo(w http.ResponseWriter, startTime *time.Time, o *Oracle) {
+	cfg := o.config
+	pushStats := o.pushQueue.stats()
+	pushStats.Workers = cfg.Push.Workers
+	connStats := o.limiter.stats()
+	connStats.Users = o.onlineUsers()
 	w.Header().Add("Content-Type", "application/json")
 	info, _ := json.MarshalIndent(Info{
-		Status:     "healthy",
-		StartTime:  *startTime,
-		DataLenMax: cfg.DataLenMax,
-		MsgTTL:     int(cfg.MsgTTL.Seconds()),
-		UserTTL:    int(cfg.UserTTL.Seconds()),
+		Status:          "healthy",
+		StartTime:       *startTime,
+		DataLenMax:      cfg.DataLenMax,
+		ShareableLenMax: cfg.ShareableLenMax,
+		MsgLenMax:       cfg.MsgLenMax,
+		SlotQuota:       cfg.SlotQuota,
+		MsgTTL:          int(cfg.MsgTTL.Seconds()),
+		UserTTL:         int(cfg.UserTTL.Seconds()),
+		Push:            pushStats,
+		Connections:     connStats,
+		WebhookKey:      o.webhookQueue.publicKey,
 	}, "", "\t")
 	w.Write(info)
 }
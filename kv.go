@@ -2,9 +2,7 @@ package main
 
 import (
 	"crypto/tls"
-	"encoding/base64"
 	"errors"
-	"hash/fnv"
 	"log"
 	"net/rpc"
 	"sync"
@@ -23,10 +21,12 @@ type GobkvConfig struct {
 // Keeps a connection to gobkv up
 // Lock is for getting client ready
 // Rlock are for normal operations
+// ready is closed once first connected
 type GobkvClient struct {
 	client     *rpc.Client
 	mux        *sync.RWMutex
 	authSecret string
+	ready      chan struct{}
 }
 
 func (kv *GobkvClient) get(key string) ([]byte, error) {
@@ -57,9 +57,7 @@ func (kv *GobkvClient) set(key string, value []byte) error {
 // Key is given prefix + base64 hash of value.
 // Returns key & done channel
 func (kv *GobkvClient) setAuto(prefix string, value []byte) (string, chan *rpc.Call) {
-	h := fnv.New64a()
-	h.Write(value)
-	key := prefix + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	key := prefix + messageId(value)
 	kv.mux.RLock()
 	defer kv.mux.RUnlock()
 	rpcArgs := common.Args{
@@ -143,6 +141,7 @@ func (kv *GobkvClient) keepClientUp(cfg *GobkvConfig) {
 		log.Fatal("failed to get gobkv client conn:", err)
 	}
 	log.Println("connected to gobkv at", cfg.Address)
+	close(kv.ready)
 	printedConnError := false
 	for {
 		if err := kv.ping(); err != nil {
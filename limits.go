@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const userLimitEvict = "evict"
+const userLimitReject = "reject"
+
+var errTooManyConnections = errors.New("too many connections")
+
+// Zero limits are unlimited
+type LimitConfig struct {
+	MaxPerUser     int
+	MaxPerIP       int
+	MaxTotal       int
+	UserLimit      string // evict oldest or reject newest when MaxPerUser is reached
+	ClientIPHeader string // trusted header with the client IP, like Fly-Client-IP
+}
+
+// Counts open connections, globally & by IP
+type ConnLimiter struct {
+	config *LimitConfig
+	mux    *sync.Mutex
+	total  int
+	byIP   map[string]int
+}
+
+type ConnStats struct {
+	Total int `json:"total"`
+	IPs   int `json:"ips"`
+	Users int `json:"users"`
+}
+
+func newConnLimiter(cfg *LimitConfig) *ConnLimiter {
+	return &ConnLimiter{
+		config: cfg,
+		mux:    new(sync.Mutex),
+		byIP:   make(map[string]int),
+	}
+}
+
+func (l *ConnLimiter) clientIP(r *http.Request) string {
+	if l.config.ClientIPHeader != "" {
+		// X-Forwarded-For style headers list the client first
+		header := r.Header.Get(l.config.ClientIPHeader)
+		if ip := strings.TrimSpace(strings.Split(header, ",")[0]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Count a new connection from ip, unless over a limit
+func (l *ConnLimiter) acquire(ip string) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.config.MaxTotal > 0 && l.total >= l.config.MaxTotal {
+		return errTooManyConnections
+	}
+	if l.config.MaxPerIP > 0 && l.byIP[ip] >= l.config.MaxPerIP {
+		return errTooManyConnections
+	}
+	l.total++
+	l.byIP[ip]++
+	return nil
+}
+
+func (l *ConnLimiter) release(ip string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.total--
+	l.byIP[ip]--
+	if l.byIP[ip] < 1 {
+		delete(l.byIP, ip)
+	}
+}
+
+func (l *ConnLimiter) stats() ConnStats {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return ConnStats{
+		Total: l.total,
+		IPs:   len(l.byIP),
+	}
+}
@@ -10,11 +10,17 @@ import (
 )
 
 type Info struct {
-	Status     string    `json:"status"`
-	StartTime  time.Time `json:"startTime"`
-	DataLenMax int       `json:"dataLenMax"`
-	MsgTTL     int       `json:"msgTtl"`
-	UserTTL    int       `json:"userTtl"`
+	Status          string    `json:"status"`
+	StartTime       time.Time `json:"startTime"`
+	DataLenMax      int       `json:"dataLenMax"`
+	ShareableLenMax int       `json:"shareableLenMax"`
+	MsgLenMax       int       `json:"msgLenMax"`
+	SlotQuota       int       `json:"slotQuota"`
+	MsgTTL          int       `json:"msgTtl"`
+	UserTTL         int       `json:"userTtl"`
+	Push            PushStats `json:"push"`
+	Connections     ConnStats `json:"connections"`
+	WebhookKey      string    `json:"webhookKey"`
 }
 
 func main() {
@@ -26,40 +32,92 @@ func main() {
 	}
 	log.Printf("%+v'\n", cfg)
 
+	err = loadVAPID(&cfg.Push)
+	if err != nil {
+		log.Fatal("failed to load VAPID keys", err)
+	}
+
 	kv := GobkvClient{
 		mux:        new(sync.RWMutex),
 		authSecret: cfg.Gobkv.AuthSecret,
+		ready:      make(chan struct{}),
 	}
 	go kv.keepClientUp(&cfg.Gobkv)
 
+	webhookQueue, err := newWebhookQueue(&cfg.Webhook)
+	if err != nil {
+		log.Fatal("failed to load webhook key", err)
+	}
+
 	oracle := Oracle{
-		users:  make(map[string]*User),
-		mux:    new(sync.RWMutex),
-		config: &cfg,
-		kv:     &kv,
+		users:        make(map[string]*User),
+		mux:          new(sync.RWMutex),
+		config:       &cfg,
+		kv:           &kv,
+		pushQueue:    newPushQueue(&cfg.Push),
+		limiter:      newConnLimiter(&cfg.Limits),
+		webhookQueue: webhookQueue,
+		groupMux:     new(sync.Mutex),
+		scheduler:    newScheduler(),
 	}
 
 	go oracle.keepClean()
+	go oracle.keepScheduling()
+
+	err = loadSessionSecret(&cfg.Session)
+	if err != nil {
+		log.Fatal("failed to load session secret", err)
+	}
+
+	upgrader.CheckOrigin = cfg.Origins.checkOrigin
+	upgrader.ReadBufferSize = cfg.WebSocket.ReadBufferSize
+	upgrader.WriteBufferSize = cfg.WebSocket.WriteBufferSize
+	upgrader.EnableCompression = cfg.WebSocket.Compression
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
+		cfg.Origins.setCORSHeaders(w, r)
+		if r.Method == "OPTIONS" {
+			w.Header().Add("Access-Control-Allow-Headers", "Authorization")
+			w.Header().Add("Access-Control-Allow-Methods", "GET, POST, DELETE")
+			return
+		}
+		if isGroupPath(r.URL.Path) {
+			handleGroup(w, r, &oracle)
+			return
+		}
+		if isScheduledPath(r.URL.Path) {
+			handleScheduled(w, r, &oracle)
+			return
+		}
+		if isInboxPath(r.URL.Path) {
+			handleInbox(w, r, &oracle)
+			return
+		}
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/session") {
+			handlePostSession(w, r, &cfg)
+			return
+		}
 		if r.Method == "POST" {
 			handlePost(w, r, &oracle)
 			return
 		}
 		if r.URL.Path == "/info" {
-			handleGetInfo(w, &startTime, &cfg)
+			handleGetInfo(w, &startTime, &oracle)
 			return
 		}
 		if strings.HasSuffix(r.URL.Path, "/shareable") {
 			handleGetShareable(w, r, &oracle)
 			return
 		}
-		if strings.HasSuffix(r.URL.Path, "/turn") {
-			if r.Method == "OPTIONS" {
-				w.Header().Add("Access-Control-Allow-Headers", "Authorization")
-				return
+		if strings.HasSuffix(r.URL.Path, "/sse") || strings.HasSuffix(r.URL.Path, "/poll") {
+			if strings.HasSuffix(r.URL.Path, "/sse") {
+				handleSSE(w, r, &oracle)
+			} else {
+				handlePoll(w, r, &oracle)
 			}
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/turn") {
 			handleGetTurnInfo(w, r, &cfg.Turn)
 			return
 		}
@@ -79,6 +137,12 @@ func main() {
 	}
 }
 
+// Second path segment is "inbox"
+func isInboxPath(path string) bool {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	return len(segments) > 1 && segments[1] == "inbox"
+}
+
 func getIdFromPath(path string) string {
 	// remove beginning "/"
 	cleaned := strings.TrimLeft(path, "/")
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/shamaton/msgpack/v3"
+)
+
+const minutesPerDay = 24 * 60
+
+// Notification settings, stored at <id>/notify
+type NotifySettings struct {
+	Muted      [][]byte     `msgpack:"muted" json:"muted"`           // sender ids
+	QuietHours []QuietHours `msgpack:"quietHours" json:"quietHours"` // in TimeZone
+	TimeZone   string       `msgpack:"timeZone" json:"timeZone"`     // IANA name, defaults to UTC
+	HideSender bool         `msgpack:"hideSender" json:"hideSender"` // omit sender id from payload
+}
+
+// Window in minutes after midnight.
+// If End is before Start, the window spans midnight.
+type QuietHours struct {
+	Start int `msgpack:"start" json:"start"`
+	End   int `msgpack:"end" json:"end"`
+}
+
+func (s *NotifySettings) validate() error {
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		return errors.New("invalid time zone")
+	}
+	for _, q := range s.QuietHours {
+		if q.Start < 0 || q.Start >= minutesPerDay || q.End < 0 || q.End >= minutesPerDay {
+			return errors.New("quiet hours must be minutes within a day")
+		}
+	}
+	return nil
+}
+
+func (s *NotifySettings) isMuted(from []byte) bool {
+	for _, m := range s.Muted {
+		if bytes.Equal(m, from) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *NotifySettings) isQuiet(t time.Time) bool {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	for _, q := range s.QuietHours {
+		if q.Start <= q.End {
+			if minute >= q.Start && minute < q.End {
+				return true
+			}
+		} else if minute >= q.Start || minute < q.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Get settings, loading them from storage on first use
+func (u *User) getNotifySettings(kv *GobkvClient) *NotifySettings {
+	u.mux.RLock()
+	settings := u.notify
+	u.mux.RUnlock()
+	if settings != nil {
+		return settings
+	}
+	settings = &NotifySettings{}
+	stored, err := kv.get(u.id + "/notify")
+	if err == nil && len(stored) > 0 {
+		msgpack.Unmarshal(stored, settings)
+	}
+	u.mux.Lock()
+	u.notify = settings
+	u.mux.Unlock()
+	return settings
+}
+
+func (u *User) setNotifySettings(settings *NotifySettings, kv *GobkvClient) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	marshalled, err := msgpack.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	err = kv.set(u.id+"/notify", marshalled)
+	if err != nil {
+		return err
+	}
+	u.mux.Lock()
+	u.notify = settings
+	u.mux.Unlock()
+	return nil
+}
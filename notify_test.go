@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsQuiet(t *testing.T) {
+	s := NotifySettings{
+		QuietHours: []QuietHours{
+			{Start: 22 * 60, End: 7 * 60}, // spans midnight
+			{Start: 12 * 60, End: 13 * 60},
+		},
+	}
+	cases := []struct {
+		hour, minute int
+		want         bool
+	}{
+		{21, 59, false},
+		{22, 0, true},
+		{23, 30, true},
+		{0, 0, true},
+		{6, 59, true},
+		{7, 0, false},
+		{12, 30, true},
+		{13, 0, false},
+	}
+	for _, c := range cases {
+		at := time.Date(2024, 1, 1, c.hour, c.minute, 0, 0, time.UTC)
+		if got := s.isQuiet(at); got != c.want {
+			t.Errorf("isQuiet(%02d:%02d) = %v, want %v", c.hour, c.minute, got, c.want)
+		}
+	}
+}
+
+func TestIsQuietInTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no tz database", err)
+	}
+	s := NotifySettings{
+		QuietHours: []QuietHours{{Start: 22 * 60, End: 7 * 60}},
+		TimeZone:   "Asia/Tokyo",
+	}
+	// 23:00 in Tokyo is 14:00 UTC
+	if !s.isQuiet(time.Date(2024, 1, 1, 23, 0, 0, 0, loc).UTC()) {
+		t.Error("expected quiet at 23:00 local")
+	}
+	if s.isQuiet(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)) {
+		t.Error("expected not quiet at 08:00 local")
+	}
+}
+
+func TestIsQuietWithoutHours(t *testing.T) {
+	s := NotifySettings{}
+	if s.isQuiet(time.Now()) {
+		t.Error("expected not quiet without quiet hours")
+	}
+}
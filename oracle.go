@@ -9,10 +9,15 @@ import (
 )
 
 type Oracle struct {
-	users  map[string]*User
-	mux    *sync.RWMutex
-	config *Config
-	kv     *GobkvClient
+	users        map[string]*User
+	mux          *sync.RWMutex
+	config       *Config
+	kv           *GobkvClient
+	pushQueue    *PushQueue
+	limiter      *ConnLimiter
+	webhookQueue *WebhookQueue
+	groupMux     *sync.Mutex // serialises group operations
+	scheduler    *Scheduler
 }
 
 func (o *Oracle) getUser(id string, makeIfNotFound bool) (*User, error) {
@@ -20,9 +25,6 @@ func (o *Oracle) getUser(id string, makeIfNotFound bool) (*User, error) {
 	u := o.users[id]
 	o.mux.RUnlock()
 	if u != nil {
-		if u.mux == nil {
-			u.mux = new(sync.RWMutex)
-		}
 		return u, nil
 	} else if makeIfNotFound {
 		// validate id
@@ -30,21 +32,43 @@ func (o *Oracle) getUser(id string, makeIfNotFound bool) (*User, error) {
 		if err != nil || len(idBytes) != 32 {
 			return nil, errors.New("invalid id")
 		}
-		// make one
+		// make one, unless made since checking
 		o.mux.Lock()
+		defer o.mux.Unlock()
+		if u := o.users[id]; u != nil {
+			return u, nil
+		}
 		o.users[id] = &User{
-			id:    id,
-			conns: make([]Connection, 0),
-			mux:   new(sync.RWMutex),
+			id:      id,
+			conns:   make([]*Connection, 0),
+			mux:     new(sync.RWMutex),
+			dataMux: new(sync.Mutex),
+			pusher: Pusher{
+				mux: new(sync.Mutex),
+			},
+			signals: newSignalLimiter(&o.config.Signal),
 		}
-		defer o.mux.Unlock()
 		return o.users[id], nil
 	}
 	return nil, errors.New("no user found")
 }
 
+func (o *Oracle) onlineUsers() int {
+	o.mux.RLock()
+	defer o.mux.RUnlock()
+	online := 0
+	for _, u := range o.users {
+		if len(u.connections()) > 0 {
+			online++
+		}
+	}
+	return online
+}
+
 func (o *Oracle) keepClean() {
+	<-o.kv.ready
 	for {
+		remaining := []*User{}
 		o.mux.Lock()
 		for id, u := range o.users {
 			// remove user if:
@@ -56,12 +80,19 @@ func (o *Oracle) keepClean() {
 			// has no shareable data )
 			expires := u.lastConnection.Add(o.config.UserTTL.Duration)
 			hasExpired := time.Now().After(expires)
-			if !u.online && hasExpired {
+			// keep users watched for presence, to tell
+			// watchers when they come online
+			if !u.online && hasExpired && !u.hasWatchers() {
 				delete(o.users, id)
 				log.Println("cleaned up", id)
+			} else {
+				remaining = append(remaining, u)
 			}
 		}
 		o.mux.Unlock()
+		for _, u := range remaining {
+			u.expirePendingReceipts(o.kv)
+		}
 		time.Sleep(o.config.CleanPeriod.Duration)
 	}
 }
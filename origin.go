@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Origins allowed to open sockets & make CORS requests.
+// Entries are origins like "https://example.com", may use
+// a wildcard subdomain like "https://*.example.com",
+// or be "*" to allow any origin.
+type OriginConfig struct {
+	Allowed       []string
+	AllowNoOrigin bool // allow clients that send no Origin, like non-browser clients
+}
+
+func (cfg *OriginConfig) allows(origin string) bool {
+	if origin == "" {
+		return cfg.AllowNoOrigin
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, allowed := range cfg.Allowed {
+		if allowed == "*" {
+			return true
+		}
+		a, err := url.Parse(allowed)
+		if err != nil || a.Scheme != u.Scheme {
+			continue
+		}
+		if strings.HasPrefix(a.Host, "*.") {
+			if strings.HasSuffix(u.Host, a.Host[1:]) {
+				return true
+			}
+		} else if a.Host == u.Host {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *OriginConfig) checkOrigin(r *http.Request) bool {
+	return cfg.allows(r.Header.Get("Origin"))
+}
+
+// Set CORS headers if the request's origin is allowed
+func (cfg *OriginConfig) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !cfg.allows(origin) {
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Access-Control-Allow-Origin", origin)
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestOriginAllows(t *testing.T) {
+	cfg := OriginConfig{
+		Allowed: []string{"https://example.com", "https://*.example.org"},
+	}
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://example.com", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+		{"https://evil.com", false},
+		{"https://app.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := cfg.allows(c.origin); got != c.want {
+			t.Errorf("allows(%q) = %v, want %v", c.origin, got, c.want)
+		}
+	}
+}
+
+func TestOriginAllowsAny(t *testing.T) {
+	cfg := OriginConfig{
+		Allowed:       []string{"*"},
+		AllowNoOrigin: true,
+	}
+	for _, origin := range []string{"https://example.com", "http://localhost:3000", ""} {
+		if !cfg.allows(origin) {
+			t.Errorf("allows(%q) = false, want true", origin)
+		}
+	}
+}
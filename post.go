@@ -1,26 +1,111 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 )
 
+const resultDelivered = "delivered"
+const resultStored = "stored"
+const resultForwarded = "forwarded"
+const resultDropped = "dropped"
+
+// Id is the message id, as in receipts & the inbox
+type PostResponse struct {
+	Id     string `json:"id"`
+	Result string `json:"result"`
+}
+
 func handlePost(w http.ResponseWriter, r *http.Request, oracle *Oracle) {
-	body, err := io.ReadAll(r.Body)
+	body, err := readMessage(r.Body, oracle.config)
 	if err != nil {
 		http.Error(w, "failed to read body", http.StatusBadRequest)
 		return
 	}
 	r.Body.Close()
 	id := getIdFromPath(r.URL.Path)
-	user, err := oracle.getUser(id, true)
+
+	queryValues := r.URL.Query()
+	d := Delivery{
+		Store: queryValues.Get("store") != "false",
+	}
+	// receipts go to the authenticated sender
+	if queryValues.Get("receipt") == "true" {
+		senderId, ok := authenticatedSender(r, oracle.config)
+		if !ok {
+			http.Error(w, "receipts need sender auth", http.StatusUnauthorized)
+			return
+		}
+		d.ReceiptTo = senderId
+	}
+
+	if queryValues.Has("deliverAt") {
+		handlePostScheduled(w, r, id, body, d, oracle)
+		return
+	}
+
+	result, err := oracle.deliver(id, body, d)
 	if err != nil {
-		http.Error(w, "failed to get user", http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
+	resp, _ := json.Marshal(PostResponse{
+		Id:     messageId(body),
+		Result: result,
+	})
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(resp)
+}
 
-	queryValues := r.URL.Query()
-	doStore := queryValues.Get("store") != "false"
+// Validate & send message to recipient.
+// Used by POST & the WebSocket send op.
+func (o *Oracle) deliver(id string, msg []byte, d Delivery) (string, error) {
+	if err := checkMsgLen(msg, o.config); err != nil {
+		return "", err
+	}
+	user, err := o.getUser(id, true)
+	if err != nil {
+		return "", newProtocolError(codeBadRequest, "failed to get user")
+	}
+	return user.sendMessage(msg, o, d), nil
+}
+
+// Read a message body, at most one byte past MsgLenMax,
+// so checkMsgLen can reject it
+func readMessage(body io.Reader, cfg *Config) ([]byte, error) {
+	if cfg.MsgLenMax > 0 {
+		body = io.LimitReader(body, int64(cfg.MsgLenMax)+1)
+	}
+	return io.ReadAll(body)
+}
+
+// MsgLenMax of 0 is unlimited
+func checkMsgLen(msg []byte, cfg *Config) error {
+	if cfg.MsgLenMax > 0 && len(msg) > cfg.MsgLenMax {
+		return newLimitError("message", cfg.MsgLenMax)
+	}
+	return nil
+}
 
-	user.sendMessage(body, oracle, doStore)
+func httpStatus(err error) int {
+	var pErr *ProtocolError
+	if !errors.As(err, &pErr) {
+		return http.StatusInternalServerError
+	}
+	switch pErr.Code {
+	case codeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case codeBadRequest:
+		return http.StatusBadRequest
+	case codeUnauthorized:
+		return http.StatusUnauthorized
+	case codeConflict:
+		return http.StatusConflict
+	case codeQuotaExceeded, codeRateLimited:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
 }
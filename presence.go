@@ -0,0 +1,183 @@
+package main
+
+import (
+	"github.com/shamaton/msgpack/v3"
+)
+
+// Presence is shared only with ids the user allows,
+// stored at <id>/presence. Allowed contacts subscribe
+// over v1, & get presence events as the user's first
+// connection opens & last connection closes.
+// Long-poll connections come & go with each poll,
+// so they don't count.
+
+const opSetPresence = "setPresence"
+const opGetPresence = "getPresence"
+const opSubscribePresence = "subscribePresence"
+const opUnsubscribePresence = "unsubscribePresence"
+const opPresence = "presence"
+
+type Presence struct {
+	Id       string `msgpack:"id" json:"id"`
+	Online   bool   `msgpack:"online" json:"online"`
+	LastSeen int64  `msgpack:"lastSeen" json:"lastSeen"` // unix ms
+}
+
+// A connection subscribed to a user's presence
+type presenceWatcher struct {
+	id   string
+	conn *Connection
+}
+
+func (u *User) presenceKey() string {
+	return u.id + "/presence"
+}
+
+func (u *User) getPresenceAllowed(kv *GobkvClient) ([]string, error) {
+	allowedBin, err := kv.get(u.presenceKey())
+	if err != nil {
+		return nil, err
+	}
+	allowed := []string{}
+	if len(allowedBin) > 0 {
+		err = msgpack.Unmarshal(allowedBin, &allowed)
+	}
+	return allowed, err
+}
+
+// Replace the ids allowed to see presence,
+// dropping watchers no longer allowed
+func (u *User) setPresenceAllowed(ids []string, kv *GobkvClient) error {
+	allowed := validIds(ids)
+	allowedBin, _ := msgpack.Marshal(allowed)
+	err := kv.set(u.presenceKey(), allowedBin)
+	if err != nil {
+		return err
+	}
+	u.mux.Lock()
+	keep := []presenceWatcher{}
+	for _, w := range u.watchers {
+		if contains(allowed, w.id) {
+			keep = append(keep, w)
+		}
+	}
+	u.watchers = keep
+	u.mux.Unlock()
+	return nil
+}
+
+func (u *User) presence() Presence {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	p := Presence{
+		Id:     u.id,
+		Online: isPresent(u.conns),
+	}
+	if !u.lastConnection.IsZero() {
+		p.LastSeen = u.lastConnection.UnixMilli()
+	}
+	return p
+}
+
+// Subscribe conn to the presence of each id allowing it.
+// Returns the current presence of those ids, omitting others.
+func subscribePresence(ids []string, user *User, conn *Connection, o *Oracle) ([]Presence, error) {
+	if len(ids) == 0 || len(ids) > shareableIdsMax {
+		return nil, newProtocolError(codeBadRequest, "ids must have 1 to %v entries", shareableIdsMax)
+	}
+	presence := make([]Presence, 0, len(ids))
+	for _, id := range ids {
+		contact, err := o.getUser(id, true)
+		if err != nil {
+			continue
+		}
+		allowed, err := contact.getPresenceAllowed(o.kv)
+		if err != nil {
+			return nil, err
+		}
+		if !contains(allowed, user.id) {
+			continue
+		}
+		contact.addWatcher(presenceWatcher{user.id, conn})
+		presence = append(presence, contact.presence())
+	}
+	return presence, nil
+}
+
+func unsubscribePresence(ids []string, conn *Connection, o *Oracle) {
+	for _, id := range ids {
+		contact, err := o.getUser(id, false)
+		if err == nil {
+			contact.removeWatcher(conn)
+		}
+	}
+}
+
+func (u *User) addWatcher(w presenceWatcher) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	for _, existing := range u.watchers {
+		if existing.conn == w.conn {
+			return
+		}
+	}
+	u.watchers = append(u.watchers, w)
+}
+
+func (u *User) removeWatcher(conn *Connection) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	keep := []presenceWatcher{}
+	for _, w := range u.watchers {
+		if w.conn != conn {
+			keep = append(keep, w)
+		}
+	}
+	u.watchers = keep
+}
+
+// Online for presence, with any connection but long-polls
+func isPresent(conns []*Connection) bool {
+	for _, c := range conns {
+		if !c.transient {
+			return true
+		}
+	}
+	return false
+}
+
+// Prune closed watchers, reporting if any remain,
+// so users being watched are not cleaned up
+func (u *User) hasWatchers() bool {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	keep := []presenceWatcher{}
+	for _, w := range u.watchers {
+		if !w.conn.isClosed() {
+			keep = append(keep, w)
+		}
+	}
+	u.watchers = keep
+	return len(keep) > 0
+}
+
+// Send presence to watchers, pruning closed connections
+func (u *User) broadcastPresence() {
+	event := Response{
+		Op:       opPresence,
+		Status:   statusOk,
+		Presence: []Presence{u.presence()},
+	}
+	u.mux.Lock()
+	keep := []presenceWatcher{}
+	for _, w := range u.watchers {
+		if !w.conn.isClosed() {
+			keep = append(keep, w)
+		}
+	}
+	u.watchers = keep
+	u.mux.Unlock()
+	for _, w := range keep {
+		w.conn.writeEnvelope(event)
+	}
+}
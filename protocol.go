@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Negotiated with Sec-WebSocket-Protocol.
+// Clients that offer no protocol speak v0, the unversioned Message.
+// Clients offering auth in Sec-WebSocket-Protocol must also offer
+// a version, as browsers fail a handshake where none is selected.
+const protocolV0 = "npchat.v0"
+const protocolV1 = "npchat.v1"
+
+const opAuth = "auth"
+const opSetSub = "setSub"
+const opSetPushPrefs = "setPushPrefs"
+const opSetNotify = "setNotify"
+const opSetData = "setData"
+const opSetShareable = "setShareable"
+const opSend = "send"
+const opGetData = "getData"
+const opGetShareable = "getShareable"
+const opGetCounts = "getCounts"
+const opSetWebhook = "setWebhook"
+const opAck = "ack"
+
+// Most contacts' shareable records fetched in one request
+const shareableIdsMax = 64
+
+const statusOk = "ok"
+const statusError = "error"
+
+const codeBadRequest = "badRequest"
+const codeUnknownOp = "unknownOp"
+const codeTooLarge = "tooLarge"
+const codeInvalidSub = "invalidSub"
+const codeStorage = "storage"
+const codeConflict = "conflict"
+const codeUnauthorized = "unauthorized"
+const codeQuotaExceeded = "quotaExceeded"
+
+// v1 envelope. Id is chosen by the client, & echoed in the Response.
+type Request struct {
+	Op            string          `msgpack:"op" json:"op"`
+	Id            uint64          `msgpack:"id" json:"id"`
+	PushSub       string          `msgpack:"sub" json:"sub"`
+	PushPrefs     *PushPrefs      `msgpack:"pushPrefs" json:"pushPrefs"`
+	Notify        *NotifySettings `msgpack:"notify" json:"notify"`
+	Data          []byte          `msgpack:"data" json:"data"`
+	ShareableData []byte          `msgpack:"shareableData" json:"shareableData"`
+	To            string          `msgpack:"to" json:"to"`
+	Body          []byte          `msgpack:"body" json:"body"`
+	Store         *bool           `msgpack:"store" json:"store"` // defaults to true
+	Ids           []string        `msgpack:"ids" json:"ids"`
+	Version       uint64          `msgpack:"version" json:"version"`
+	Slot          string          `msgpack:"slot" json:"slot"`
+	URL           string          `msgpack:"url" json:"url"`
+	Receipt       bool            `msgpack:"receipt" json:"receipt"`
+}
+
+// Error replied to the client with a code,
+// & the limit exceeded for codeTooLarge
+type ProtocolError struct {
+	Code    string
+	Message string
+	Limit   int
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func newProtocolError(code string, format string, a ...interface{}) *ProtocolError {
+	return &ProtocolError{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func newLimitError(field string, limit int) *ProtocolError {
+	return &ProtocolError{
+		Code:    codeTooLarge,
+		Message: fmt.Sprintf("%s exceeds %v bytes", field, limit),
+		Limit:   limit,
+	}
+}
+
+// Handle one v1 request & build its response
+func handleRequest(req *Request, user *User, conn *Connection, o *Oracle) Response {
+	var err error
+	switch req.Op {
+	case opSetSub:
+		err = user.setPushSub(req.PushSub)
+	case opSetPushPrefs:
+		if req.PushPrefs == nil {
+			err = newProtocolError(codeBadRequest, "missing pushPrefs")
+			break
+		}
+		user.pusher.setPrefs(*req.PushPrefs)
+	case opSetNotify:
+		if req.Notify == nil {
+			err = newProtocolError(codeBadRequest, "missing notify")
+			break
+		}
+		err = user.setNotifySettings(req.Notify, o.kv)
+		if err != nil {
+			err = newProtocolError(codeBadRequest, err.Error())
+		}
+	case opSetData:
+		// version is the one last seen by the client
+		version, current, err := user.writeData(req.Data, &req.Version, o, conn)
+		resp := makeResponse(req, err)
+		resp.Version = version
+		resp.Data = current
+		return resp
+	case opSetShareable:
+		version, err := user.writeShareable(req.ShareableData, o, conn)
+		resp := makeResponse(req, err)
+		resp.Version = version
+		return resp
+	case opSend:
+		var result string
+		result, err = handleSendRequest(req, user, o)
+		resp := makeResponse(req, err)
+		resp.Result = result
+		if err == nil {
+			resp.MsgId = messageId(req.Body)
+		}
+		return resp
+	case opGetData:
+		data, version, err := user.getVersionedData(o.kv)
+		resp := makeResponse(req, err)
+		resp.Data = data
+		resp.Version = version
+		return resp
+	case opGetShareable:
+		shareable, err := handleGetShareableRequest(req, o)
+		resp := makeResponse(req, err)
+		resp.Shareable = shareable
+		return resp
+	case opGetCounts:
+		counts, err := user.getCounts(o.kv)
+		resp := makeResponse(req, err)
+		resp.Counts = counts
+		return resp
+	case opSignal:
+		var result string
+		result, err = handleSignalRequest(req, user, conn, o)
+		resp := makeResponse(req, err)
+		resp.Result = result
+		return resp
+	case opSetPresence:
+		err = user.setPresenceAllowed(req.Ids, o.kv)
+	case opGetPresence:
+		ids, err := user.getPresenceAllowed(o.kv)
+		resp := makeResponse(req, err)
+		resp.Ids = ids
+		return resp
+	case opSubscribePresence:
+		presence, err := subscribePresence(req.Ids, user, conn, o)
+		resp := makeResponse(req, err)
+		resp.Presence = presence
+		return resp
+	case opUnsubscribePresence:
+		unsubscribePresence(req.Ids, conn, o)
+	case opAck:
+		user.ackMessages(req.Ids, o)
+	case opSetWebhook:
+		err = user.setWebhook(req.URL, o.kv)
+	case opGetSlot, opSetSlot, opListSlots, opDelSlot:
+		return handleSlotRequest(req, user, conn, o)
+	default:
+		err = newProtocolError(codeUnknownOp, "unknown op %q", req.Op)
+	}
+	return makeResponse(req, err)
+}
+
+// Collect shareable records by id, omitting ids with none
+func handleGetShareableRequest(req *Request, o *Oracle) (map[string][]byte, error) {
+	if len(req.Ids) == 0 || len(req.Ids) > shareableIdsMax {
+		return nil, newProtocolError(codeBadRequest, "ids must have 1 to %v entries", shareableIdsMax)
+	}
+	shareable := make(map[string][]byte)
+	for _, id := range req.Ids {
+		data, err := getShareable(id, o.kv)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			shareable[id] = data
+		}
+	}
+	return shareable, nil
+}
+
+func handleSendRequest(req *Request, user *User, o *Oracle) (string, error) {
+	if req.To == "" || req.Body == nil {
+		return "", newProtocolError(codeBadRequest, "missing to or body")
+	}
+	d := Delivery{
+		Store: req.Store == nil || *req.Store,
+	}
+	if req.Receipt {
+		d.ReceiptTo = user.id
+	}
+	return o.deliver(req.To, req.Body, d)
+}
+
+func makeResponse(req *Request, err error) Response {
+	resp := Response{
+		Op:     req.Op,
+		Id:     req.Id,
+		Status: statusOk,
+	}
+	if err != nil {
+		resp.Status = statusError
+		resp.Err = err.Error()
+		resp.Code = codeStorage
+		var pErr *ProtocolError
+		if errors.As(err, &pErr) {
+			resp.Code = pErr.Code
+			resp.Err = pErr.Message
+			resp.Limit = pErr.Limit
+		}
+	}
+	return resp
+}
+
+// Decode & handle v1 request, replying on the connection
+func handleRequestBin(reqBin []byte, user *User, conn *Connection, o *Oracle) {
+	var req Request
+	var resp Response
+	err := decodeEnvelope(reqBin, conn.encoding, &req)
+	if err != nil {
+		resp = makeResponse(&req, newProtocolError(codeBadRequest, "failed to decode request"))
+	} else {
+		resp = handleRequest(&req, user, conn, o)
+	}
+	if !conn.writeEnvelope(resp) {
+		log.Println("failed to queue response")
+	}
+}
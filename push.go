@@ -1,17 +1,158 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
+	"net/http"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/SherClockHolmes/webpush-go"
 )
 
+type PushConfig struct {
+	Workers         int
+	QueueSize       int
+	Throttle        Duration
+	TTL             Duration
+	Urgency         string
+	Topic           string
+	Subscriber      string
+	VAPIDMode       string
+	VAPIDPublicKey  string
+	VAPIDPrivateKey string
+	VAPIDKeyFile    string
+	AllowPrivate    bool // allow endpoints on loopback & private addresses
+}
+
+// Per-user overrides of PushConfig.
+// Zero values fall back to the server defaults.
+type PushPrefs struct {
+	Throttle int    `msgpack:"throttle" json:"throttle"` // seconds
+	TTL      int    `msgpack:"ttl" json:"ttl"`           // seconds
+	Urgency  string `msgpack:"urgency" json:"urgency"`
+	Topic    string `msgpack:"topic" json:"topic"`
+}
+
 type Pusher struct {
-	sub        *webpush.Subscription
+	provider   PushProvider
 	privateKey string
 	publicKey  string
 	last       time.Time
+	mux        *sync.Mutex
+	prefs      PushPrefs
+	suppressed int
+	trailing   *time.Timer
+}
+
+// A queued notification for one user's Pusher.
+// Trailing jobs summarise notifications suppressed by the throttle.
+type pushJob struct {
+	pusher   *Pusher
+	message  []byte
+	queued   time.Time
+	trailing bool
+}
+
+// Topic header may only use the URL-safe base64 alphabet
+var topicPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Bounded pool of workers sending push notifications,
+// so a slow push service never stalls the request path
+type PushQueue struct {
+	config       *PushConfig
+	jobs         chan pushJob
+	client       *http.Client // for all providers, as endpoints are client-chosen
+	mux          *sync.Mutex
+	sent         int
+	failed       int
+	dropped      int
+	latencyTotal time.Duration
+	latencyMax   time.Duration
+}
+
+type PushStats struct {
+	Workers      int `json:"workers"`
+	QueueLen     int `json:"queueLen"`
+	QueueSize    int `json:"queueSize"`
+	Sent         int `json:"sent"`
+	Failed       int `json:"failed"`
+	Dropped      int `json:"dropped"`
+	AvgLatencyMs int `json:"avgLatencyMs"`
+	MaxLatencyMs int `json:"maxLatencyMs"`
+}
+
+func newPushQueue(cfg *PushConfig) *PushQueue {
+	q := &PushQueue{
+		config: cfg,
+		jobs:   make(chan pushJob, cfg.QueueSize),
+		client: newGuardedClient(pushTimeout, cfg.AllowPrivate),
+		mux:    new(sync.Mutex),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Queue a notification without blocking.
+// If the queue is full, the notification is dropped.
+func (q *PushQueue) enqueue(p *Pusher, message []byte) {
+	q.enqueueJob(pushJob{
+		pusher:  p,
+		message: message,
+		queued:  time.Now(),
+	})
+}
+
+func (q *PushQueue) enqueueJob(job pushJob) bool {
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		q.mux.Lock()
+		q.dropped++
+		q.mux.Unlock()
+		log.Println("push queue full, dropped notification")
+		return false
+	}
+}
+
+func (q *PushQueue) work() {
+	for job := range q.jobs {
+		sent, err := job.pusher.push(q, &job)
+		latency := time.Since(job.queued)
+		q.mux.Lock()
+		if err != nil {
+			q.failed++
+		} else if sent {
+			q.sent++
+			q.latencyTotal += latency
+			if latency > q.latencyMax {
+				q.latencyMax = latency
+			}
+		}
+		q.mux.Unlock()
+	}
+}
+
+func (q *PushQueue) stats() PushStats {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	stats := PushStats{
+		QueueLen:     len(q.jobs),
+		QueueSize:    cap(q.jobs),
+		Sent:         q.sent,
+		Failed:       q.failed,
+		Dropped:      q.dropped,
+		MaxLatencyMs: int(q.latencyMax.Milliseconds()),
+	}
+	if q.sent > 0 {
+		stats.AvgLatencyMs = int(q.latencyTotal.Milliseconds()) / q.sent
+	}
+	return stats
 }
 
 func (p *Pusher) generateKeys() {
@@ -24,33 +165,162 @@ func (p *Pusher) generateKeys() {
 	}
 }
 
-func (p *Pusher) ensureKey() {
+// Returns the VAPID public key the client should subscribe with
+func (p *Pusher) ensureKey(cfg *PushConfig) string {
+	if cfg.VAPIDMode == vapidModeServer {
+		return cfg.VAPIDPublicKey
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
 	if p.publicKey == "" {
 		p.generateKeys()
 	}
+	return p.publicKey
 }
 
-func (p *Pusher) addSubscription(subscription *webpush.Subscription) {
-	p.sub = subscription
+func (p *Pusher) addSubscription(provider PushProvider) {
+	p.mux.Lock()
+	p.provider = provider
 	p.last = time.Now()
+	p.mux.Unlock()
 }
 
-func (p *Pusher) push(subscriber string, message []byte) {
-	if p.sub == nil {
-		return
+// Set per-user preferences, ignoring invalid urgency or topic
+func (p *Pusher) setPrefs(prefs PushPrefs) {
+	if prefs.Urgency != "" && !isValidUrgency(prefs.Urgency) {
+		log.Println("ignoring invalid push urgency", prefs.Urgency)
+		prefs.Urgency = ""
+	}
+	if prefs.Topic != "" && !topicPattern.MatchString(prefs.Topic) {
+		log.Println("ignoring invalid push topic", prefs.Topic)
+		prefs.Topic = ""
 	}
-	if time.Now().Before(p.last.Add(time.Minute)) {
-		return
+	if prefs.Throttle < 0 {
+		prefs.Throttle = 0
 	}
-	resp, err := webpush.SendNotification(message, p.sub, &webpush.Options{
-		Subscriber:      subscriber,
+	if prefs.TTL < 0 {
+		prefs.TTL = 0
+	}
+	p.mux.Lock()
+	p.prefs = prefs
+	p.mux.Unlock()
+}
+
+// Resolve push options from user preferences & server defaults
+func (p *Pusher) options(cfg *PushConfig, client webpush.HTTPClient) (time.Duration, webpush.Options) {
+	throttle := cfg.Throttle.Duration
+	if p.prefs.Throttle > 0 {
+		throttle = time.Duration(p.prefs.Throttle) * time.Second
+	}
+	opts := webpush.Options{
+		Subscriber:      cfg.Subscriber,
 		VAPIDPublicKey:  p.publicKey,
 		VAPIDPrivateKey: p.privateKey,
-		TTL:             120,
-	})
-	if err != nil {
-		log.Println("failed to send push notification", err)
+		TTL:             int(cfg.TTL.Seconds()),
+		Urgency:         webpush.Urgency(cfg.Urgency),
+		Topic:           cfg.Topic,
+		HTTPClient:      client,
+	}
+	if cfg.VAPIDMode == vapidModeServer {
+		opts.VAPIDPublicKey = cfg.VAPIDPublicKey
+		opts.VAPIDPrivateKey = cfg.VAPIDPrivateKey
+	}
+	if isURLSubscriber(cfg.Subscriber) {
+		opts.HTTPClient = &vapidURLClient{
+			client:     client,
+			subscriber: cfg.Subscriber,
+			publicKey:  opts.VAPIDPublicKey,
+			privateKey: opts.VAPIDPrivateKey,
+		}
+	}
+	if p.prefs.TTL > 0 {
+		opts.TTL = p.prefs.TTL
 	}
-	resp.Body.Close()
+	if p.prefs.Urgency != "" {
+		opts.Urgency = webpush.Urgency(p.prefs.Urgency)
+	}
+	if p.prefs.Topic != "" {
+		opts.Topic = p.prefs.Topic
+	}
+	return throttle, opts
+}
+
+// Send notification, unless throttled.
+// Throttled notifications are counted, & summarised by
+// a trailing notification once the throttle window ends.
+// Returns true if a notification was sent.
+// Sends without holding mux, as a slow push service would
+// otherwise stall auth & settings changes for the user.
+// The send is claimed under mux, so concurrent jobs still throttle.
+func (p *Pusher) push(q *PushQueue, job *pushJob) (bool, error) {
+	p.mux.Lock()
+	if p.provider == nil {
+		p.mux.Unlock()
+		return false, nil
+	}
+	throttle, opts := p.options(q.config, q.client)
+	message := job.message
+	if job.trailing {
+		p.trailing = nil
+		if p.suppressed < 1 {
+			p.mux.Unlock()
+			return false, nil
+		}
+		message, _ = json.Marshal(MsgPushNotification{
+			Type:  "summary",
+			Count: p.suppressed,
+		})
+	} else if wait := time.Until(p.last.Add(throttle)); wait > 0 {
+		p.suppressed++
+		if p.trailing == nil {
+			p.trailing = time.AfterFunc(wait, func() {
+				ok := q.enqueueJob(pushJob{
+					pusher:   p,
+					queued:   time.Now(),
+					trailing: true,
+				})
+				if !ok {
+					// allow the next burst to schedule again
+					p.mux.Lock()
+					p.trailing = nil
+					p.mux.Unlock()
+				}
+			})
+		}
+		p.mux.Unlock()
+		return false, nil
+	}
+	provider := p.provider
+	last, suppressed := p.last, p.suppressed
 	p.last = time.Now()
+	p.suppressed = 0
+	p.mux.Unlock()
+
+	err := provider.send(message, &opts, q.client)
+	if err == nil {
+		return true, nil
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	// give back the claimed send
+	p.last = last
+	p.suppressed += suppressed
+	if errors.Is(err, errSubscriptionGone) {
+		log.Println("push subscription gone, removed it")
+		// unless replaced meanwhile
+		if p.provider == provider {
+			p.provider = nil
+		}
+		return false, err
+	}
+	log.Println("failed to send push notification", err)
+	return false, err
+}
+
+func isValidUrgency(urgency string) bool {
+	switch webpush.Urgency(urgency) {
+	case webpush.UrgencyVeryLow, webpush.UrgencyLow, webpush.UrgencyNormal, webpush.UrgencyHigh:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+type fakePushProvider struct {
+	sent [][]byte
+	err  error
+}
+
+func (p *fakePushProvider) send(message []byte, _ *webpush.Options, _ *http.Client) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.sent = append(p.sent, message)
+	return nil
+}
+
+// Queue without workers, so tests drive the jobs
+func newTestPushQueue(throttle time.Duration) *PushQueue {
+	return newPushQueue(&PushConfig{
+		QueueSize: 8,
+		Throttle:  Duration{throttle},
+	})
+}
+
+func newTestPusher(provider PushProvider) *Pusher {
+	return &Pusher{
+		provider: provider,
+		mux:      new(sync.Mutex),
+	}
+}
+
+func TestPushSummarisesSuppressedBurst(t *testing.T) {
+	q := newTestPushQueue(50 * time.Millisecond)
+	provider := &fakePushProvider{}
+	p := newTestPusher(provider)
+
+	for i := 0; i < 4; i++ {
+		sent, err := p.push(q, &pushJob{pusher: p, message: []byte("message")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i == 0; sent != want {
+			t.Fatalf("push %v: sent = %v, want %v", i, sent, want)
+		}
+	}
+
+	var job pushJob
+	select {
+	case job = <-q.jobs:
+	case <-time.After(time.Second):
+		t.Fatal("no trailing notification queued")
+	}
+	if !job.trailing {
+		t.Fatal("expected a trailing job")
+	}
+	sent, err := p.push(q, &job)
+	if err != nil || !sent {
+		t.Fatalf("trailing push: sent = %v, err = %v", sent, err)
+	}
+	select {
+	case <-q.jobs:
+		t.Fatal("expected one trailing notification per burst")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if len(provider.sent) != 2 {
+		t.Fatalf("sent %v notifications, want 2", len(provider.sent))
+	}
+	summary := MsgPushNotification{}
+	err = json.Unmarshal(provider.sent[1], &summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Type != "summary" || summary.Count != 3 {
+		t.Errorf("got %+v, want summary of 3", summary)
+	}
+}
+
+func TestPushRollsBackFailedSend(t *testing.T) {
+	q := newTestPushQueue(time.Hour)
+	provider := &fakePushProvider{err: errors.New("unavailable")}
+	p := newTestPusher(provider)
+	p.suppressed = 2
+
+	sent, err := p.push(q, &pushJob{pusher: p, message: []byte("message")})
+	if err == nil || sent {
+		t.Fatalf("sent = %v, err = %v, want failure", sent, err)
+	}
+	if !p.last.IsZero() || p.suppressed != 2 {
+		t.Fatalf("last = %v, suppressed = %v, want rolled back", p.last, p.suppressed)
+	}
+
+	// the failed send must not throttle the next
+	provider.err = nil
+	sent, err = p.push(q, &pushJob{pusher: p, message: []byte("message")})
+	if err != nil || !sent {
+		t.Fatalf("sent = %v, err = %v, want sent", sent, err)
+	}
+	if p.suppressed != 0 {
+		t.Errorf("suppressed = %v, want 0", p.suppressed)
+	}
+}
+
+func TestPushRemovesGoneSubscription(t *testing.T) {
+	q := newTestPushQueue(time.Hour)
+	p := newTestPusher(&fakePushProvider{err: errSubscriptionGone})
+
+	_, err := p.push(q, &pushJob{pusher: p, message: []byte("message")})
+	if !errors.Is(err, errSubscriptionGone) {
+		t.Fatalf("err = %v, want errSubscriptionGone", err)
+	}
+	if p.provider != nil {
+		t.Error("expected subscription removed")
+	}
+}
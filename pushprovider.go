@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+const pushTypeWebPush = "webpush"
+const pushTypeUnifiedPush = "unifiedpush"
+const pushTypeWebhook = "webhook"
+
+// Returned when the push service no longer knows the subscription
+var errSubscriptionGone = errors.New("push subscription gone")
+
+// Push services can hang, so requests time out
+// rather than holding a worker forever
+const pushTimeout = time.Second * time.Duration(15)
+
+// Subscription registered by the client in Message.PushSub.
+// Type selects the provider, & defaults to Web Push.
+type PushSubscription struct {
+	Type     string       `json:"type"`
+	Endpoint string       `json:"endpoint"`
+	Keys     webpush.Keys `json:"keys"`
+	Secret   string       `json:"secret"`
+}
+
+type PushProvider interface {
+	send(message []byte, opts *webpush.Options, client *http.Client) error
+}
+
+// Web Push, encrypted & signed with VAPID keys
+type webPushProvider struct {
+	sub webpush.Subscription
+}
+
+// UnifiedPush distributor, receives the raw payload
+type unifiedPushProvider struct {
+	endpoint string
+}
+
+// Generic HTTP callback, signed with the client's secret
+type webhookPushProvider struct {
+	endpoint string
+	secret   string
+}
+
+func newPushProvider(subJSON []byte) (PushProvider, error) {
+	sub := PushSubscription{}
+	err := json.Unmarshal(subJSON, &sub)
+	if err != nil {
+		return nil, err
+	}
+	switch sub.Type {
+	case "", pushTypeWebPush:
+		if !strings.HasPrefix(sub.Endpoint, "https://") {
+			return nil, errors.New("web push endpoint must be https")
+		}
+		if sub.Keys.Auth == "" || sub.Keys.P256dh == "" {
+			return nil, errors.New("web push subscription has no keys")
+		}
+		return &webPushProvider{
+			sub: webpush.Subscription{
+				Endpoint: sub.Endpoint,
+				Keys:     sub.Keys,
+			},
+		}, nil
+	case pushTypeUnifiedPush:
+		if !isHTTPEndpoint(sub.Endpoint) {
+			return nil, errors.New("unifiedpush endpoint must be http(s)")
+		}
+		return &unifiedPushProvider{endpoint: sub.Endpoint}, nil
+	case pushTypeWebhook:
+		if !isHTTPEndpoint(sub.Endpoint) {
+			return nil, errors.New("webhook endpoint must be http(s)")
+		}
+		if sub.Secret == "" {
+			return nil, errors.New("webhook subscription has no secret")
+		}
+		return &webhookPushProvider{
+			endpoint: sub.Endpoint,
+			secret:   sub.Secret,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown push type %q", sub.Type)
+	}
+}
+
+func isHTTPEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "https://") || strings.HasPrefix(endpoint, "http://")
+}
+
+func (p *webPushProvider) send(message []byte, opts *webpush.Options, _ *http.Client) error {
+	resp, err := webpush.SendNotification(message, &p.sub, opts)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return checkPushStatus(resp)
+}
+
+func (p *unifiedPushProvider) send(message []byte, opts *webpush.Options, client *http.Client) error {
+	req, err := http.NewRequest("POST", p.endpoint, bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(opts.TTL))
+	if opts.Topic != "" {
+		req.Header.Set("Topic", opts.Topic)
+	}
+	if opts.Urgency != "" {
+		req.Header.Set("Urgency", string(opts.Urgency))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return checkPushStatus(resp)
+}
+
+// Signature is hex HMAC-SHA256 of "<timestamp>.<body>"
+func (p *webhookPushProvider) send(message []byte, _ *webpush.Options, client *http.Client) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(p.secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(message)
+	req, err := http.NewRequest("POST", p.endpoint, bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Npchat-Timestamp", timestamp)
+	req.Header.Set("X-Npchat-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return checkPushStatus(resp)
+}
+
+func checkPushStatus(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errSubscriptionGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service replied %v", resp.Status)
+	}
+	return nil
+}
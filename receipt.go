@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"hash/fnv"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/shamaton/msgpack/v3"
+)
+
+const receiptDelivered = "delivered"
+const receiptRead = "read"
+
+// Sent to the sender's inbox, without recipient or content
+type Receipt struct {
+	Type   string `msgpack:"type"` // always "receipt"
+	Id     string `msgpack:"id"`
+	Time   int64  `msgpack:"time"` // unix ms
+	Status string `msgpack:"status"`
+}
+
+// Id of a message, as in its storage key
+func messageId(msg []byte) string {
+	h := fnv.New64a()
+	h.Write(msg)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Pending receipts are stored at <id>/receipt/<msgId>
+// until the message is acked, or MsgTTL passes
+func (u *User) receiptPrefix() string {
+	return u.id + "/receipt/"
+}
+
+type PendingReceipt struct {
+	Sender  string `msgpack:"sender"`
+	Expires int64  `msgpack:"expires"` // unix s
+}
+
+func (u *User) addPendingReceipt(msgId string, senderId string, o *Oracle) {
+	pending, _ := msgpack.Marshal(PendingReceipt{
+		Sender:  senderId,
+		Expires: time.Now().Add(o.config.MsgTTL.Duration).Unix(),
+	})
+	err := o.kv.set(u.receiptPrefix()+msgId, pending)
+	if err != nil {
+		log.Println("failed to store pending receipt", err)
+	}
+}
+
+// Returns the sender's id, or "" if none is pending
+func (u *User) getPendingReceipt(msgId string, kv *GobkvClient) string {
+	pendingBin, err := kv.get(u.receiptPrefix() + msgId)
+	if err != nil || len(pendingBin) == 0 {
+		return ""
+	}
+	pending := PendingReceipt{}
+	err = msgpack.Unmarshal(pendingBin, &pending)
+	if err != nil || time.Now().Unix() > pending.Expires {
+		kv.del(u.receiptPrefix() + msgId)
+		return ""
+	}
+	return pending.Sender
+}
+
+// Remove pending receipts past MsgTTL
+func (u *User) expirePendingReceipts(kv *GobkvClient) {
+	keys, err := kv.list(u.receiptPrefix())
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		u.getPendingReceipt(strings.TrimPrefix(key, u.receiptPrefix()), kv)
+	}
+}
+
+func (o *Oracle) emitReceipt(senderId string, msgId string, status string) {
+	sender, err := o.getUser(senderId, true)
+	if err != nil {
+		log.Println("failed to get receipt sender", err)
+		return
+	}
+	receipt, _ := msgpack.Marshal(Receipt{
+		Type:   "receipt",
+		Id:     msgId,
+		Time:   time.Now().UnixMilli(),
+		Status: status,
+	})
+	sender.sendMessage(receipt, o, Delivery{
+		Store:  true,
+		Silent: true,
+	})
+}
+
+// Mark messages as read, by inbox or message id,
+// emitting any pending read receipts
+func (u *User) ackMessages(ids []string, o *Oracle) {
+	for _, id := range ids {
+		if strings.Contains(id, "/") {
+			continue
+		}
+		o.kv.del(u.unreadPrefix() + id)
+		msgId := inboxMessageId(id)
+		senderId := u.getPendingReceipt(msgId, o.kv)
+		if senderId != "" {
+			o.kv.del(u.receiptPrefix() + msgId)
+			o.emitReceipt(senderId, msgId, receiptRead)
+		}
+	}
+}
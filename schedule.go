@@ -0,0 +1,315 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shamaton/msgpack/v3"
+)
+
+// Messages POSTed with ?deliverAt=<unix ms> are held until then,
+// by the authenticated sender, who can list & cancel them.
+//   GET    /<id>/scheduled             list sender's scheduled messages
+//   DELETE /<id>/scheduled/<schedId>   cancel
+// Each is stored at schedule/<deliverAt as hex>/<schedId>,
+// so keys sort by time, & indexed at <sender>/scheduled/<schedId>.
+// Pending keys are loaded into a heap once at start, so the
+// keyspace isn't listed on every check. Cancelled keys stay
+// in the heap, & are skipped when due.
+
+const schedulePrefix = "schedule/"
+
+type ScheduleConfig struct {
+	Period     Duration // between checks for due messages
+	MaxAhead   Duration // furthest a message may be scheduled
+	MaxPerUser int      // pending per sender
+}
+
+// Min-heap of pending schedule keys, earliest first.
+// storeMux serialises scheduling, claiming due messages &
+// cancelling, so a cancel either wins or finds nothing.
+type Scheduler struct {
+	mux      *sync.Mutex
+	keys     scheduleHeap
+	storeMux *sync.Mutex
+}
+
+type scheduleHeap []string
+
+func (h scheduleHeap) Len() int            { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h scheduleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scheduleHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
+func newScheduler() *Scheduler {
+	return &Scheduler{
+		mux:      new(sync.Mutex),
+		storeMux: new(sync.Mutex),
+	}
+}
+
+func (s *Scheduler) add(key string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	heap.Push(&s.keys, key)
+}
+
+// Pop keys sorting before due
+func (s *Scheduler) popDue(due string) []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	keys := []string{}
+	for len(s.keys) > 0 && s.keys[0] <= due {
+		keys = append(keys, heap.Pop(&s.keys).(string))
+	}
+	return keys
+}
+
+type ScheduledMessage struct {
+	Id        string `msgpack:"id" json:"id"`
+	To        string `msgpack:"to" json:"to"`
+	From      string `msgpack:"from" json:"-"`
+	DeliverAt int64  `msgpack:"deliverAt" json:"deliverAt"` // unix ms
+	Store     bool   `msgpack:"store" json:"store"`
+	Receipt   bool   `msgpack:"receipt" json:"receipt"`
+	Body      []byte `msgpack:"body" json:"-"`
+}
+
+func isScheduledPath(path string) bool {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	return len(segments) > 1 && segments[1] == "scheduled"
+}
+
+func scheduledIndexPrefix(senderId string) string {
+	return senderId + "/scheduled/"
+}
+
+func scheduleKey(deliverAt int64, schedId string) string {
+	return fmt.Sprintf("%s%016x/%s", schedulePrefix, deliverAt, schedId)
+}
+
+// Parse deliverAt, within MaxAhead
+func parseDeliverAt(value string, cfg *ScheduleConfig) (int64, error) {
+	deliverAt, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || deliverAt < 0 {
+		return 0, newProtocolError(codeBadRequest, "deliverAt must be unix ms")
+	}
+	if time.UnixMilli(deliverAt).After(time.Now().Add(cfg.MaxAhead.Duration)) {
+		return 0, newProtocolError(codeBadRequest, "deliverAt is over %v ahead", cfg.MaxAhead.Duration)
+	}
+	return deliverAt, nil
+}
+
+// Hold message until deliverAt
+func (o *Oracle) schedule(msg *ScheduledMessage) error {
+	if err := checkMsgLen(msg.Body, o.config); err != nil {
+		return err
+	}
+	if !isValidId(msg.To) {
+		return newProtocolError(codeBadRequest, "invalid id %v", msg.To)
+	}
+	o.scheduler.storeMux.Lock()
+	defer o.scheduler.storeMux.Unlock()
+	pending, err := o.kv.list(scheduledIndexPrefix(msg.From))
+	if err != nil {
+		return err
+	}
+	if len(pending) >= o.config.Schedule.MaxPerUser {
+		return newProtocolError(codeQuotaExceeded, "at most %v messages may be scheduled", o.config.Schedule.MaxPerUser)
+	}
+	idBytes := make([]byte, 16)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return err
+	}
+	msg.Id = base64.RawURLEncoding.EncodeToString(idBytes)
+	msgBin, _ := msgpack.Marshal(msg)
+	key := scheduleKey(msg.DeliverAt, msg.Id)
+	err = o.kv.set(key, msgBin)
+	if err != nil {
+		return err
+	}
+	err = o.kv.set(scheduledIndexPrefix(msg.From)+msg.Id, []byte(key))
+	if err != nil {
+		return err
+	}
+	o.scheduler.add(key)
+	return nil
+}
+
+// Schedule a POSTed message, held for the authenticated sender
+func handlePostScheduled(w http.ResponseWriter, r *http.Request, id string, body []byte, d Delivery, o *Oracle) {
+	senderId, ok := authenticatedSender(r, o.config)
+	if !ok {
+		http.Error(w, "scheduling needs sender auth", http.StatusUnauthorized)
+		return
+	}
+	deliverAt, err := parseDeliverAt(r.URL.Query().Get("deliverAt"), &o.config.Schedule)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	msg := ScheduledMessage{
+		To:        id,
+		From:      senderId,
+		DeliverAt: deliverAt,
+		Store:     d.Store,
+		Receipt:   d.ReceiptTo != "",
+		Body:      body,
+	}
+	err = o.schedule(&msg)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	resp, _ := json.Marshal(msg)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(resp)
+}
+
+// Load pending keys once the store is connected,
+// then deliver due messages every Period
+func (o *Oracle) keepScheduling() {
+	<-o.kv.ready
+	keys, err := o.kv.list(schedulePrefix)
+	if err != nil {
+		log.Println("failed to list scheduled messages", err)
+	}
+	for _, key := range keys {
+		o.scheduler.add(key)
+	}
+	for {
+		o.deliverDue()
+		time.Sleep(o.config.Schedule.Period.Duration)
+	}
+}
+
+func (o *Oracle) deliverDue() {
+	due := scheduleKey(time.Now().UnixMilli(), "~")
+	for _, key := range o.scheduler.popDue(due) {
+		msg, ok, err := o.claimScheduled(key)
+		if err != nil {
+			log.Println("failed to get scheduled message", key, err)
+			o.scheduler.add(key) // retry next check
+			continue
+		}
+		// cancelled since scheduled
+		if !ok {
+			continue
+		}
+		d := Delivery{
+			Store: msg.Store,
+		}
+		if msg.Receipt {
+			d.ReceiptTo = msg.From
+		}
+		_, err = o.deliver(msg.To, msg.Body, d)
+		if err != nil {
+			log.Println("failed to deliver scheduled message", msg.Id, err)
+		}
+	}
+}
+
+// Take a due message from the store, unless cancelled
+func (o *Oracle) claimScheduled(key string) (ScheduledMessage, bool, error) {
+	o.scheduler.storeMux.Lock()
+	defer o.scheduler.storeMux.Unlock()
+	msg := ScheduledMessage{}
+	msgBin, err := o.kv.get(key)
+	if err != nil {
+		return msg, false, err
+	}
+	o.kv.del(key)
+	if len(msgBin) == 0 || msgpack.Unmarshal(msgBin, &msg) != nil {
+		return msg, false, nil
+	}
+	o.kv.del(scheduledIndexPrefix(msg.From) + msg.Id)
+	return msg, true, nil
+}
+
+func handleScheduled(w http.ResponseWriter, r *http.Request, o *Oracle) {
+	senderId, ok := checkRequestAuth(w, r, o.config)
+	if !ok {
+		return
+	}
+	// path is /<id>/scheduled[/<schedId>]
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	schedId := ""
+	if len(segments) > 2 {
+		schedId = segments[2]
+	}
+	switch {
+	case r.Method == "GET" && schedId == "":
+		handleListScheduled(w, senderId, o)
+	case r.Method == "DELETE" && schedId != "":
+		handleCancelScheduled(w, senderId, schedId, o)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func handleListScheduled(w http.ResponseWriter, senderId string, o *Oracle) {
+	indexKeys, err := o.kv.list(scheduledIndexPrefix(senderId))
+	if err != nil {
+		http.Error(w, "failed to list scheduled messages", http.StatusInternalServerError)
+		return
+	}
+	scheduled := make([]ScheduledMessage, 0, len(indexKeys))
+	for _, indexKey := range indexKeys {
+		key, err := o.kv.get(indexKey)
+		if err != nil || len(key) == 0 {
+			continue
+		}
+		msgBin, err := o.kv.get(string(key))
+		msg := ScheduledMessage{}
+		if err != nil || len(msgBin) == 0 || msgpack.Unmarshal(msgBin, &msg) != nil {
+			continue
+		}
+		scheduled = append(scheduled, msg)
+	}
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].DeliverAt < scheduled[j].DeliverAt
+	})
+	resp, _ := json.Marshal(scheduled)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// Cancel, responding 404 if already delivered or cancelled
+func handleCancelScheduled(w http.ResponseWriter, senderId string, schedId string, o *Oracle) {
+	o.scheduler.storeMux.Lock()
+	defer o.scheduler.storeMux.Unlock()
+	indexKey := scheduledIndexPrefix(senderId) + schedId
+	key, err := o.kv.get(indexKey)
+	if err != nil {
+		http.Error(w, "failed to get scheduled message", http.StatusInternalServerError)
+		return
+	}
+	if len(key) == 0 {
+		http.Error(w, "nothing scheduled for id "+schedId, http.StatusNotFound)
+		return
+	}
+	err = o.kv.del(string(key))
+	if err != nil {
+		http.Error(w, "failed to cancel", http.StatusInternalServerError)
+		return
+	}
+	o.kv.del(indexKey)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Session tokens let HTTP clients authenticate repeatedly
+// without signing an auth message for every request.
+// A token is "<expiry>.<id>.<mac>", where mac is the
+// base64 HMAC-SHA256 of "<expiry>.<id>" with Secret.
+type SessionConfig struct {
+	Secret string // random per start if empty
+	TTL    Duration
+}
+
+type SessionResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Generate a secret if none is configured
+func loadSessionSecret(cfg *SessionConfig) error {
+	if cfg.Secret != "" {
+		return nil
+	}
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return err
+	}
+	cfg.Secret = base64.RawURLEncoding.EncodeToString(secret)
+	log.Println("no session secret defined, tokens will not survive restart")
+	return nil
+}
+
+func signSession(payload string, cfg *SessionConfig) string {
+	mac := hmac.New(sha256.New, []byte(cfg.Secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func makeSessionToken(idEnc string, cfg *SessionConfig) SessionResponse {
+	expires := time.Now().Add(cfg.TTL.Duration)
+	payload := fmt.Sprintf("%d.%s", expires.Unix(), idEnc)
+	return SessionResponse{
+		Token:   payload + "." + signSession(payload, cfg),
+		Expires: expires,
+	}
+}
+
+func verifySessionToken(token string, idEnc string, cfg *SessionConfig) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[1] != idEnc {
+		return false
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(signSession(payload, cfg))) {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Before(time.Unix(expiry, 0))
+}
+
+// Authenticate an HTTP request with a bearer session token,
+// an auth message in the Authorization header,
+// or in the auth query param if allowed
+func authenticateRequest(r *http.Request, idEnc string, id []byte, cfg *Config) bool {
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return verifySessionToken(strings.TrimPrefix(authHeader, "Bearer "), idEnc, &cfg.Session)
+	}
+	return authenticateSigned(r, id, cfg)
+}
+
+// Authenticate with a signed auth message only,
+// in the Authorization header or the auth query param if allowed
+func authenticateSigned(r *http.Request, id []byte, cfg *Config) bool {
+	authMsg, err := getAuthMsgFromHeader(r)
+	if err != nil && cfg.WebSocket.AllowQueryAuth {
+		authMsg, err = getAuthMsgFromQuery(r)
+	}
+	return err == nil && verifyAuthMessage(&authMsg, id)
+}
+
+// Id of the client authenticated by the Authorization header,
+// for requests made on behalf of another id, like POST
+func authenticatedSender(r *http.Request, cfg *Config) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		token := strings.TrimPrefix(authHeader, "Bearer ")
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 || !verifySessionToken(token, parts[1], &cfg.Session) {
+			return "", false
+		}
+		return parts[1], true
+	}
+	authMsg, err := getAuthMsgFromHeader(r)
+	if err != nil {
+		return "", false
+	}
+	h := sha256.Sum256(authMsg.PublicKey)
+	if !verifyAuthMessage(&authMsg, h[:]) {
+		return "", false
+	}
+	return publicKeyId(authMsg.PublicKey), true
+}
+
+// Decode id from path & authenticate the request.
+// On failure, an error is written & false returned.
+func checkRequestAuth(w http.ResponseWriter, r *http.Request, cfg *Config) (string, bool) {
+	idEnc, id, ok := checkPathId(w, r)
+	if ok && !authenticateRequest(r, idEnc, id, cfg) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return idEnc, false
+	}
+	return idEnc, ok
+}
+
+func checkPathId(w http.ResponseWriter, r *http.Request) (string, []byte, bool) {
+	idEnc := getIdFromPath(r.URL.Path)
+	id, err := base64.RawURLEncoding.DecodeString(idEnc)
+	if err != nil || len(id) != 32 {
+		http.Error(w, fmt.Sprintf("invalid id %v", idEnc), http.StatusBadRequest)
+		return idEnc, nil, false
+	}
+	return idEnc, id, true
+}
+
+// Exchange a signed auth message for a session token.
+// Tokens are not accepted, so they can't be renewed past TTL.
+func handlePostSession(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	idEnc, id, ok := checkPathId(w, r)
+	if !ok {
+		return
+	}
+	if !authenticateSigned(r, id, cfg) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	resp, _ := json.Marshal(makeSessionToken(idEnc, &cfg.Session))
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSessionId = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+func testSessionConfig() *SessionConfig {
+	return &SessionConfig{
+		Secret: "test-secret",
+		TTL:    Duration{time.Hour},
+	}
+}
+
+func TestVerifySessionToken(t *testing.T) {
+	cfg := testSessionConfig()
+	token := makeSessionToken(testSessionId, cfg).Token
+	if !verifySessionToken(token, testSessionId, cfg) {
+		t.Error("fresh token does not verify")
+	}
+	if verifySessionToken(token, "B"+testSessionId[1:], cfg) {
+		t.Error("token verifies for another id")
+	}
+	other := testSessionConfig()
+	other.Secret = "other-secret"
+	if verifySessionToken(token, testSessionId, other) {
+		t.Error("token verifies with another secret")
+	}
+}
+
+func TestVerifySessionTokenRejectsTampering(t *testing.T) {
+	cfg := testSessionConfig()
+	token := makeSessionToken(testSessionId, cfg).Token
+	parts := strings.Split(token, ".")
+	// push the expiry out, keeping the mac
+	extended := fmt.Sprintf("%d.%s.%s", time.Now().Add(time.Hour*time.Duration(24)).Unix(), parts[1], parts[2])
+	for _, bad := range []string{extended, parts[0] + "." + parts[1], "", "a.b.c.d"} {
+		if verifySessionToken(bad, testSessionId, cfg) {
+			t.Errorf("tampered token %q verifies", bad)
+		}
+	}
+}
+
+func TestVerifySessionTokenExpires(t *testing.T) {
+	cfg := testSessionConfig()
+	cfg.TTL = Duration{-time.Second}
+	token := makeSessionToken(testSessionId, cfg).Token
+	if verifySessionToken(token, testSessionId, cfg) {
+		t.Error("expired token verifies")
+	}
+}
@@ -9,10 +9,14 @@ func handleGetShareable(w http.ResponseWriter, r *http.Request, o *Oracle) {
 
 	w.Header().Add("Content-Type", "application/json")
 
-	data, err := o.kv.get(id + "/shareable")
+	data, err := getShareable(id, o.kv)
 	if err != nil || len(data) == 0 {
 		http.Error(w, "nothing found for id "+id, http.StatusNotFound)
 	}
 
 	w.Write(data)
 }
+
+func getShareable(id string, kv *GobkvClient) ([]byte, error) {
+	return kv.get(id + "/shareable")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const opSignal = "signal"
+
+const codeRateLimited = "rateLimited"
+
+// Signals are ephemeral events between online users,
+// like WebRTC offers, ICE candidates or typing indicators.
+// They are never stored, pushed or forwarded.
+type SignalConfig struct {
+	Rate   float64 // signals per second, per sender
+	Burst  int
+	LenMax int
+}
+
+// Token bucket limiting a sender's signals
+type SignalLimiter struct {
+	mux    *sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newSignalLimiter(cfg *SignalConfig) *SignalLimiter {
+	return &SignalLimiter{
+		mux:    new(sync.Mutex),
+		tokens: float64(cfg.Burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *SignalLimiter) allow(cfg *SignalConfig) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * cfg.Rate
+	if l.tokens > float64(cfg.Burst) {
+		l.tokens = float64(cfg.Burst)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Send body as a signal event to the recipient's v1 connections,
+// except the sending one, so a user can signal their other devices
+func handleSignalRequest(req *Request, user *User, conn *Connection, o *Oracle) (string, error) {
+	cfg := &o.config.Signal
+	if req.To == "" || req.Body == nil {
+		return "", newProtocolError(codeBadRequest, "missing to or body")
+	}
+	if len(req.Body) > cfg.LenMax {
+		return "", newLimitError("signal", cfg.LenMax)
+	}
+	if !user.signals.allow(cfg) {
+		return "", newProtocolError(codeRateLimited, "too many signals")
+	}
+	recipient, err := o.getUser(req.To, false)
+	if err != nil {
+		return resultDropped, nil
+	}
+	event := Response{
+		Op:     opSignal,
+		Status: statusOk,
+		From:   user.id,
+		Data:   req.Body,
+	}
+	delivered := false
+	for _, c := range recipient.connections() {
+		if c != conn && c.version == 1 && c.writeEnvelope(event) {
+			delivered = true
+		}
+	}
+	if delivered {
+		return resultDelivered, nil
+	}
+	return resultDropped, nil
+}
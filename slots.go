@@ -0,0 +1,161 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/shamaton/msgpack/v3"
+)
+
+const opGetSlot = "getSlot"
+const opSetSlot = "setSlot"
+const opListSlots = "listSlots"
+const opDelSlot = "delSlot"
+
+var slotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Named data, stored at <id>/slot/<name>.
+// Deleting leaves a tombstone with the next version,
+// so versions never repeat across delete & recreate.
+type Slot struct {
+	Version uint64 `msgpack:"version"`
+	Data    []byte `msgpack:"data"`
+	Deleted bool   `msgpack:"deleted"`
+}
+
+type SlotInfo struct {
+	Name    string `msgpack:"name" json:"name"`
+	Version uint64 `msgpack:"version" json:"version"`
+	Size    int    `msgpack:"size" json:"size"`
+}
+
+func isValidSlotName(name string) bool {
+	return slotNamePattern.MatchString(name) && name != slotData && name != slotShareable
+}
+
+func (u *User) slotPrefix() string {
+	return u.id + "/slot/"
+}
+
+// Get slot, version 0 if it does not exist
+func (u *User) getSlot(name string, kv *GobkvClient) (Slot, error) {
+	slot := Slot{}
+	stored, err := kv.get(u.slotPrefix() + name)
+	if err != nil || len(stored) == 0 {
+		return slot, err
+	}
+	err = msgpack.Unmarshal(stored, &slot)
+	return slot, err
+}
+
+func (u *User) listSlots(kv *GobkvClient) ([]SlotInfo, error) {
+	keys, err := kv.list(u.slotPrefix())
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SlotInfo, 0, len(keys))
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, u.slotPrefix())
+		slot, err := u.getSlot(name, kv)
+		if err != nil {
+			return nil, err
+		}
+		if slot.Deleted {
+			continue
+		}
+		infos = append(infos, SlotInfo{
+			Name:    name,
+			Version: slot.Version,
+			Size:    len(slot.Data),
+		})
+	}
+	return infos, nil
+}
+
+// Write slot if expected matches its version, within the
+// user's quota. Returns the new version, or on conflict
+// the current version & data. A nil data deletes the slot.
+func (u *User) writeSlot(name string, data []byte, expected uint64, o *Oracle, from *Connection) (uint64, []byte, error) {
+	if !isValidSlotName(name) {
+		return 0, nil, newProtocolError(codeBadRequest, "invalid slot name")
+	}
+	if len(data) > o.config.DataLenMax {
+		return 0, nil, newLimitError("slot", o.config.DataLenMax)
+	}
+	u.dataMux.Lock()
+	defer u.dataMux.Unlock()
+	slot, err := u.getSlot(name, o.kv)
+	if err != nil {
+		return 0, nil, err
+	}
+	if expected != slot.Version {
+		return slot.Version, slot.Data, newProtocolError(codeConflict, "stale version %v, current is %v", expected, slot.Version)
+	}
+	if data == nil {
+		slot = Slot{
+			Version: slot.Version + 1,
+			Deleted: true,
+		}
+	} else {
+		infos, err := u.listSlots(o.kv)
+		if err != nil {
+			return 0, nil, err
+		}
+		used := len(data)
+		for _, info := range infos {
+			if info.Name != name {
+				used += info.Size
+			}
+		}
+		if used > o.config.SlotQuota {
+			return 0, nil, newLimitError("slots", o.config.SlotQuota)
+		}
+		slot = Slot{
+			Version: slot.Version + 1,
+			Data:    data,
+		}
+	}
+	stored, err := msgpack.Marshal(slot)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = o.kv.set(u.slotPrefix()+name, stored)
+	if err != nil {
+		return 0, nil, err
+	}
+	u.broadcastChange(name, slot.Version, slot.Data, o, from)
+	return slot.Version, nil, nil
+}
+
+func handleSlotRequest(req *Request, user *User, conn *Connection, o *Oracle) Response {
+	switch req.Op {
+	case opGetSlot:
+		if !isValidSlotName(req.Slot) {
+			return makeResponse(req, newProtocolError(codeBadRequest, "invalid slot name"))
+		}
+		slot, err := user.getSlot(req.Slot, o.kv)
+		resp := makeResponse(req, err)
+		resp.Slot = req.Slot
+		resp.Version = slot.Version
+		resp.Data = slot.Data
+		return resp
+	case opSetSlot, opDelSlot:
+		data := req.Data
+		if req.Op == opDelSlot {
+			data = nil
+		} else if data == nil {
+			data = []byte{}
+		}
+		version, current, err := user.writeSlot(req.Slot, data, req.Version, o, conn)
+		resp := makeResponse(req, err)
+		resp.Slot = req.Slot
+		resp.Version = version
+		resp.Data = current
+		return resp
+	default: // opListSlots
+		infos, err := user.listSlots(o.kv)
+		resp := makeResponse(req, err)
+		resp.Slots = infos
+		return resp
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type WebSocketConfig struct {
+	ReadBufferSize       int
+	WriteBufferSize      int
+	Compression          bool // negotiate permessage-deflate
+	CompressionThreshold int  // smallest frame to compress
+	PingPeriod           Duration
+	PongWait             Duration
+	WriteWait            Duration
+	SendQueueSize        int
+	AuthTimeout          Duration // to wait for auth as first frame
+	AllowQueryAuth       bool     // accept auth in ?auth= query
+}
+
+// A client's socket, written only by its writer goroutine.
+// Writers queue messages in send, & a connection that
+// falls behind by SendQueueSize messages is closed.
+// For HTTP transports, sock is nil & a handler drains send.
+type Connection struct {
+	sock      *websocket.Conn
+	version   int
+	encoding  string
+	config    *WebSocketConfig
+	send      chan frame
+	done      chan struct{}
+	once      *sync.Once
+	transient bool // long-poll, registered only for the length of a poll
+}
+
+type frame struct {
+	msgType int
+	data    []byte
+	written func() // called once the frame is written, if set
+}
+
+func newConnection(sock *websocket.Conn, cfg *WebSocketConfig) *Connection {
+	version, encoding := parseSubprotocol(sock.Subprotocol())
+	c := &Connection{
+		sock:     sock,
+		version:  version,
+		encoding: encoding,
+		config:   cfg,
+		send:     make(chan frame, cfg.SendQueueSize),
+		done:     make(chan struct{}),
+		once:     new(sync.Once),
+	}
+	sock.SetReadDeadline(time.Now().Add(cfg.PongWait.Duration))
+	sock.SetPongHandler(func(string) error {
+		return sock.SetReadDeadline(time.Now().Add(cfg.PongWait.Duration))
+	})
+	go c.writeLoop()
+	return c
+}
+
+// Queue message without blocking.
+// Returns false if the connection is closed or too slow.
+func (c *Connection) write(msg []byte) bool {
+	return c.writeNotify(msg, nil)
+}
+
+// Queue message, calling written once it is written
+func (c *Connection) writeNotify(msg []byte, written func()) bool {
+	return c.queue(frame{websocket.BinaryMessage, msg, written})
+}
+
+// Queue message, waiting up to WriteWait for space
+func (c *Connection) writeWait(msg []byte) bool {
+	return c.writeWaitNotify(msg, nil)
+}
+
+func (c *Connection) writeWaitNotify(msg []byte, written func()) bool {
+	return c.queueWait(frame{websocket.BinaryMessage, msg, written})
+}
+
+// Queue envelope in the connection's encoding, without blocking
+func (c *Connection) writeEnvelope(v interface{}) bool {
+	f, ok := c.encodeFrame(v)
+	return ok && c.queue(f)
+}
+
+// Queue envelope, waiting up to WriteWait for space
+func (c *Connection) writeEnvelopeWait(v interface{}) bool {
+	f, ok := c.encodeFrame(v)
+	return ok && c.queueWait(f)
+}
+
+func (c *Connection) encodeFrame(v interface{}) (frame, bool) {
+	data, msgType, err := encodeEnvelope(v, c.encoding)
+	if err != nil {
+		log.Println("failed to encode envelope", err)
+		return frame{}, false
+	}
+	return frame{msgType, data, nil}, true
+}
+
+func (c *Connection) queue(f frame) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- f:
+		return true
+	default:
+		c.close()
+		return false
+	}
+}
+
+func (c *Connection) queueWait(f frame) bool {
+	timer := time.NewTimer(c.config.WriteWait.Duration)
+	defer timer.Stop()
+	select {
+	case c.send <- f:
+		return true
+	case <-c.done:
+		return false
+	case <-timer.C:
+		c.close()
+		return false
+	}
+}
+
+func (f *frame) wasWritten() {
+	if f.written != nil {
+		f.written()
+	}
+}
+
+func (c *Connection) close() {
+	c.once.Do(func() {
+		close(c.done)
+		if c.sock != nil {
+			c.sock.Close()
+		}
+	})
+}
+
+// Close with a close frame telling the client why
+func (c *Connection) closeWithReason(code int, reason string) {
+	if c.sock == nil {
+		c.close()
+		return
+	}
+	deadline := time.Now().Add(c.config.WriteWait.Duration)
+	c.sock.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	c.close()
+}
+
+func (c *Connection) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Connection) writeLoop() {
+	ticker := time.NewTicker(c.config.PingPeriod.Duration)
+	defer ticker.Stop()
+	defer c.close()
+	for {
+		select {
+		case f := <-c.send:
+			c.sock.SetWriteDeadline(time.Now().Add(c.config.WriteWait.Duration))
+			c.sock.EnableWriteCompression(len(f.data) >= c.config.CompressionThreshold)
+			err := c.sock.WriteMessage(f.msgType, f.data)
+			if err != nil {
+				return
+			}
+			f.wasWritten()
+		case <-ticker.C:
+			deadline := time.Now().Add(c.config.WriteWait.Duration)
+			err := c.sock.WriteControl(websocket.PingMessage, nil, deadline)
+			if err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Fallback transports for clients that cannot use WebSockets.
+// Both register with the User like a WebSocket connection,
+// & only receive messages. Sending still goes through POST.
+type FallbackConfig struct {
+	KeepAlive   Duration // between SSE comments
+	PollTimeout Duration // longest a poll waits for messages
+}
+
+type PollResponse struct {
+	Messages [][]byte `json:"messages"`
+}
+
+// Connection drained by an HTTP handler, rather than a socket
+func newHTTPConnection(cfg *WebSocketConfig) *Connection {
+	return &Connection{
+		config: cfg,
+		send:   make(chan frame, cfg.SendQueueSize),
+		done:   make(chan struct{}),
+		once:   new(sync.Once),
+	}
+}
+
+// Authenticate & register an HTTP connection for the user in the path.
+// On failure, an error is written & nil returned.
+func registerHTTPConnection(w http.ResponseWriter, r *http.Request, o *Oracle, transient bool) (*User, *Connection) {
+	idEnc, ok := checkRequestAuth(w, r, o.config)
+	if !ok {
+		return nil, nil
+	}
+	user, err := o.getUser(idEnc, true)
+	if err != nil {
+		http.Error(w, "failed to get user", http.StatusInternalServerError)
+		return nil, nil
+	}
+	conn := newHTTPConnection(&o.config.WebSocket)
+	conn.transient = transient
+	err = user.registerWebSocket(conn, &o.config.Limits, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return nil, nil
+	}
+	return user, conn
+}
+
+// Replay unread messages in the background,
+// as the caller is the one draining the connection
+func replayUnread(user *User, o *Oracle) chan struct{} {
+	replayed := make(chan struct{})
+	go func() {
+		user.sendUnread(o)
+		close(replayed)
+	}()
+	return replayed
+}
+
+// Stream messages as Server-Sent Events,
+// each a "message" event with base64 data
+func handleSSE(w http.ResponseWriter, r *http.Request, o *Oracle) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ip := o.limiter.clientIP(r)
+	if err := o.limiter.acquire(ip); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer o.limiter.release(ip)
+
+	user, conn := registerHTTPConnection(w, r, o, false)
+	if conn == nil {
+		return
+	}
+	defer user.unregisterWebSocket(conn)
+	defer conn.close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	replayUnread(user, o)
+
+	ticker := time.NewTicker(o.config.Fallback.KeepAlive.Duration)
+	defer ticker.Stop()
+	for {
+		var err error
+		var sent *frame
+		select {
+		case f := <-conn.send:
+			sent = &f
+			_, err = fmt.Fprintf(w, "event: message\ndata: %s\n\n", base64.StdEncoding.EncodeToString(f.data))
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case <-conn.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			log.Println("failed to write event", err)
+			return
+		}
+		flusher.Flush()
+		if sent != nil {
+			sent.wasWritten()
+		}
+	}
+}
+
+// Wait for messages, then respond with all that are queued
+func handlePoll(w http.ResponseWriter, r *http.Request, o *Oracle) {
+	ip := o.limiter.clientIP(r)
+	if err := o.limiter.acquire(ip); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer o.limiter.release(ip)
+
+	user, conn := registerHTTPConnection(w, r, o, true)
+	if conn == nil {
+		return
+	}
+	defer user.unregisterWebSocket(conn)
+	defer conn.close()
+
+	replayed := replayUnread(user, o)
+	timer := time.NewTimer(o.config.Fallback.PollTimeout.Duration)
+	defer timer.Stop()
+	resp := PollResponse{
+		Messages: make([][]byte, 0),
+	}
+	frames := make([]frame, 0)
+	// wait for the first message, & for the unread replay
+	waiting := true
+	for waiting {
+		select {
+		case f := <-conn.send:
+			frames = append(frames, f)
+			resp.Messages = append(resp.Messages, f.data)
+			waiting = replayed != nil || len(resp.Messages) == 0
+		case <-replayed:
+			replayed = nil
+			waiting = len(resp.Messages) == 0
+		case <-timer.C:
+			waiting = false
+		case <-r.Context().Done():
+			return
+		}
+	}
+	// stop taking messages, so none are queued after the drain,
+	// then take whatever else is queued. Stored messages stay
+	// unread until the response is written, so none are lost.
+	user.unregisterWebSocket(conn)
+	conn.close()
+	for draining := true; draining; {
+		select {
+		case f := <-conn.send:
+			frames = append(frames, f)
+			resp.Messages = append(resp.Messages, f.data)
+		default:
+			draining = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println("failed to write poll response", err)
+		return
+	}
+	for _, f := range frames {
+		f.wasWritten()
+	}
+}
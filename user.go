@@ -4,145 +4,285 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/shamaton/msgpack/v2"
+	"github.com/shamaton/msgpack/v3"
 )
 
 type User struct {
 	id             string
-	conns          []Connection
+	conns          []*Connection
 	online         bool
 	mux            *sync.RWMutex
+	dataMux        *sync.Mutex
 	pusher         Pusher
 	lastConnection time.Time
-}
-
-type Connection struct {
-	sock *websocket.Conn
-	mux  *sync.Mutex
+	notify         *NotifySettings
+	webhook        *string
+	signals        *SignalLimiter
+	watchers       []presenceWatcher
 }
 
 type MsgData struct {
 	From []byte `msgpack:"f"`
 }
 
+type InboxCounts struct {
+	Unread int `msgpack:"unread" json:"unread"`
+	Stored int `msgpack:"stored" json:"stored"`
+}
+
 type MsgPushNotification struct {
-	Type string `json:"type"`
-	From string `json:"from"`
+	Type  string `json:"type"`
+	From  string `json:"from,omitempty"`
+	Count int    `json:"count,omitempty"`
 }
 
-func (u *User) registerWebSocket(conn *websocket.Conn) {
-	c := Connection{
-		sock: conn,
-		mux:  new(sync.Mutex),
-	}
+// Register connection, within the per-user limit.
+// At the limit, either the oldest connection is evicted,
+// or errTooManyConnections is returned.
+// If set, registered is called before the connection is visible
+// to senders, so what it queues comes before any message.
+func (u *User) registerWebSocket(c *Connection, cfg *LimitConfig, registered func()) error {
+	var evicted *Connection
 	u.mux.Lock()
+	wasPresent := isPresent(u.conns)
+	if cfg.MaxPerUser > 0 && len(u.conns) >= cfg.MaxPerUser {
+		if cfg.UserLimit != userLimitEvict {
+			u.mux.Unlock()
+			return errTooManyConnections
+		}
+		evicted = u.conns[0]
+		u.conns = u.conns[1:]
+	}
+	if registered != nil {
+		registered()
+	}
 	u.conns = append(u.conns, c)
 	u.online = true
 	u.lastConnection = time.Now()
+	cameOnline := !wasPresent && isPresent(u.conns)
 	u.mux.Unlock()
+	if evicted != nil {
+		evicted.closeWithReason(websocket.ClosePolicyViolation, "replaced by newer connection")
+	}
+	if cameOnline {
+		u.broadcastPresence()
+	}
+	return nil
 }
 
-func (u *User) unregisterWebSocket(conn *websocket.Conn) {
-	keep := []Connection{}
+func (u *User) unregisterWebSocket(conn *Connection) {
+	keep := []*Connection{}
 	u.mux.Lock()
 	for _, c := range u.conns {
-		if c.sock != conn {
+		if c != conn {
 			keep = append(keep, c)
 		}
 	}
+	wentOffline := isPresent(u.conns) && !isPresent(keep)
 	if len(keep) < 1 {
 		u.online = false
 	}
 	u.conns = keep
 	u.lastConnection = time.Now()
 	u.mux.Unlock()
+	if wentOffline {
+		u.broadcastPresence()
+	}
+}
+
+// Snapshot of open connections
+func (u *User) connections() []*Connection {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	return append([]*Connection{}, u.conns...)
+}
+
+// How a message is delivered
+type Delivery struct {
+	Store     bool
+	Silent    bool   // no push or webhook, as for receipts
+	ReceiptTo string // id of the sender, to get receipts
+	From      []byte // sender known to the server, as for groups
 }
 
-// Store & push message
+// Store & push message, returning what became of it
 // TODO: delegate expiry/kick to KV store
 // when gobkv supports metadata & expiry.
 // TODO: handle RPC errors
-func (u *User) sendMessage(msg []byte, oracle *Oracle, doStore bool) {
+func (u *User) sendMessage(msg []byte, oracle *Oracle, d Delivery) string {
+	doStore := d.Store
+	conns := u.connections()
+	msgId := messageId(msg)
+	unreadKey := ""
 	if doStore {
 		// store it
-		prefix := u.id + "/m/"
-		oracle.kv.setAuto(prefix, msg)
-		if !u.online {
-			// add again with unread/ prefix
-			// to efficiently collect later
-			unreadPrefix := prefix + "unread/"
-			oracle.kv.setAuto(unreadPrefix, msg)
+		oracle.kv.setAuto(u.messagePrefix(), msg)
+		// & keep it unread until written to a connection,
+		// so frames dropped with a slow connection are replayed
+		unreadKey = u.unreadKey(msgId)
+		err := oracle.kv.set(unreadKey, msg)
+		if err != nil {
+			log.Println("failed to store unread msg", err)
+		}
+		if d.ReceiptTo != "" {
+			u.addPendingReceipt(msgId, d.ReceiptTo, oracle)
 		}
 	}
+	written := u.writtenCallback(unreadKey, d.ReceiptTo, msgId, oracle)
 
-	if u.online {
-		for _, c := range u.conns {
-			c.mux.Lock()
-			err := c.sock.WriteMessage(websocket.BinaryMessage, msg)
-			c.mux.Unlock()
-			if err != nil {
-				u.unregisterWebSocket(c.sock)
-				log.Println("failed to send msg, cleaned up socket", err)
-			}
+	delivered := false
+	for _, c := range conns {
+		if c.writeNotify(msg, written) {
+			delivered = true
+		} else {
+			u.unregisterWebSocket(c)
+			log.Println("failed to queue msg, cleaned up socket")
 		}
-	} else { // offline
+	}
+	if delivered {
+		// receipts are kept only for messages that can be acked
+		if d.ReceiptTo != "" && !doStore {
+			u.addPendingReceipt(msgId, d.ReceiptTo, oracle)
+		}
+		return resultDelivered
+	}
+
+	// offline, or no connection accepted it
+	if d.Silent {
 		if doStore {
-			// send notification
-			// unmarshal message to get sender
-			msgData := MsgData{}
-			err := msgpack.Unmarshal(msg, &msgData)
-			if err != nil {
-				log.Println("failed to unmarshal message")
-				u.pusher.push("", []byte("Received message"))
-			} else {
-				marshalled, _ := json.Marshal(MsgPushNotification{
-					Type: "message",
-					From: base64.RawURLEncoding.EncodeToString(msgData.From),
-				})
-				u.pusher.push("", marshalled)
-			}
+			return resultStored
 		}
-		// else message disappears silently
+		return resultDropped
+	}
+	forwarded := false
+	if url := u.getWebhook(oracle.kv); url != "" {
+		oracle.webhookQueue.enqueue(webhookJob{
+			url:     url,
+			message: msg,
+		})
+		forwarded = true
+	}
+	if doStore {
+		u.notifyMessage(msg, d.From, oracle)
+	} else if forwarded {
+		return resultForwarded
 	}
+	if doStore {
+		return resultStored
+	}
+	// message disappears silently
+	return resultDropped
+}
+
+// Send notification, unless muted or in quiet hours.
+// The sender is from, or if nil read from the message.
+func (u *User) notifyMessage(msg []byte, from []byte, oracle *Oracle) {
+	settings := u.getNotifySettings(oracle.kv)
+	if settings.isQuiet(time.Now()) {
+		return
+	}
+	msgData := MsgData{
+		From: from,
+	}
+	if from == nil {
+		// unmarshal message to get sender
+		err := msgpack.Unmarshal(msg, &msgData)
+		if err != nil {
+			log.Println("failed to unmarshal message")
+			oracle.pushQueue.enqueue(&u.pusher, []byte("Received message"))
+			return
+		}
+	}
+	if settings.isMuted(msgData.From) {
+		return
+	}
+	notification := MsgPushNotification{
+		Type: "message",
+	}
+	if !settings.HideSender {
+		notification.From = base64.RawURLEncoding.EncodeToString(msgData.From)
+	}
+	marshalled, _ := json.Marshal(notification)
+	oracle.pushQueue.enqueue(&u.pusher, marshalled)
 }
 
 // Collect & send all messages, then delete expired from storage
 // TODO: delegate expiry/kick to gobkv
 // TODO: use buffered channel to fetch & send messages concurrently
-func (u *User) sendUnread(kv *GobkvClient) {
-	u.mux.RLock()
-	defer u.mux.RUnlock()
-	msgList, err := kv.list(u.id + "/m/unread/")
+func (u *User) sendUnread(o *Oracle) {
+	kv := o.kv
+	conns := u.connections()
+	msgList, err := kv.list(u.unreadPrefix())
 	if err != nil {
 		log.Println("failed to collect msgs:", err)
 		return
 	}
+	sort.Strings(msgList) // in arrival order
 	for _, mKey := range msgList {
 		msg, err := kv.get(mKey)
 		if err != nil {
 			log.Println("failed to collect msg", mKey, err)
 			continue
 		}
-		if err != nil {
-			log.Println("failed to decode msg", mKey, err)
-			continue
-		}
-		kv.del(mKey)
-		for _, c := range u.conns {
-			c.mux.Lock()
-			err = c.sock.WriteMessage(websocket.BinaryMessage, msg)
-			if err != nil {
-				log.Println(c.sock.RemoteAddr(), "failed to send stored msg", err)
+		written := u.replayedCallback(mKey, o)
+		for _, c := range conns {
+			if !c.writeWaitNotify(msg, written) {
+				log.Println("failed to send stored msg")
 			}
-			c.mux.Unlock()
 		}
 	}
 }
 
+// Returns a callback for replaying an unread message
+func (u *User) replayedCallback(mKey string, o *Oracle) func() {
+	msgId := inboxMessageId(strings.TrimPrefix(mKey, u.unreadPrefix()))
+	return u.writtenCallback(mKey, u.getPendingReceipt(msgId, o.kv), msgId, o)
+}
+
+// Returns a callback run once the message is first written to
+// any connection, removing its unread copy if any, & emitting
+// a delivered receipt if wanted. Until then the message stays
+// unread, so a connection closed with frames queued loses none.
+func (u *User) writtenCallback(unreadKey string, receiptTo string, msgId string, o *Oracle) func() {
+	if unreadKey == "" && receiptTo == "" {
+		return nil
+	}
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() {
+			if unreadKey != "" {
+				o.kv.del(unreadKey)
+			}
+			if receiptTo != "" {
+				o.emitReceipt(receiptTo, msgId, receiptDelivered)
+			}
+		})
+	}
+}
+
+// Count unread messages, & all stored messages
+func (u *User) getCounts(kv *GobkvClient) (*InboxCounts, error) {
+	unread, err := kv.list(u.unreadPrefix())
+	if err != nil {
+		return nil, err
+	}
+	// listing the message prefix includes unread copies
+	all, err := kv.list(u.messagePrefix())
+	if err != nil {
+		return nil, err
+	}
+	return &InboxCounts{
+		Unread: len(unread),
+		Stored: len(all) - len(unread),
+	}, nil
+}
+
 func (u *User) setData(data []byte, kv *GobkvClient) error {
 	return kv.set(u.id+"/data", data)
 }
@@ -151,9 +291,15 @@ func (u *User) getData(kv *GobkvClient) ([]byte, error) {
 	return kv.get(u.id + "/data")
 }
 
-func (u *User) setShareableData(shareableData []byte, kv *GobkvClient) {
-	err := kv.set(u.id+"/shareable", shareableData)
+func (u *User) setShareableData(shareableData []byte, kv *GobkvClient) error {
+	return kv.set(u.id+"/shareable", shareableData)
+}
+
+func (u *User) setPushSub(sub string) error {
+	provider, err := newPushProvider([]byte(sub))
 	if err != nil {
-		log.Println("failed to store shareable", err)
+		return newProtocolError(codeInvalidSub, err.Error())
 	}
+	u.pusher.addSubscription(provider)
+	return nil
 }
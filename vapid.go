@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/golang-jwt/jwt"
+)
+
+const vapidModeUser = "user"
+const vapidModeServer = "server"
+
+type VAPIDKeys struct {
+	PublicKey  string `json:"publicKey"`
+	PrivateKey string `json:"privateKey"`
+}
+
+// Validate VAPID mode & subscriber, and load server-wide keys.
+// In server mode, keys come from config, else from the key file.
+// A missing key file is created with a new key pair.
+func loadVAPID(cfg *PushConfig) error {
+	cfg.Subscriber = strings.TrimPrefix(cfg.Subscriber, "mailto:")
+	if cfg.Subscriber == "" {
+		log.Println("no push subscriber contact defined, some push services may reject notifications")
+	}
+	switch cfg.VAPIDMode {
+	case vapidModeUser:
+		return nil
+	case vapidModeServer:
+	default:
+		return fmt.Errorf("invalid VAPID mode %q", cfg.VAPIDMode)
+	}
+	if cfg.VAPIDPublicKey != "" && cfg.VAPIDPrivateKey != "" {
+		return nil
+	}
+	keys := VAPIDKeys{}
+	if cfg.VAPIDKeyFile == "" {
+		log.Println("no VAPID keys or key file defined, generated keys will not survive restart")
+	} else {
+		err := read(cfg.VAPIDKeyFile, &keys)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if keys.PublicKey == "" || keys.PrivateKey == "" {
+		var err error
+		keys.PrivateKey, keys.PublicKey, err = webpush.GenerateVAPIDKeys()
+		if err != nil {
+			return err
+		}
+		log.Println("got new server VAPID keys", keys.PublicKey)
+		if cfg.VAPIDKeyFile != "" {
+			if err := writeVAPIDKeys(cfg.VAPIDKeyFile, &keys); err != nil {
+				return err
+			}
+		}
+	}
+	cfg.VAPIDPublicKey = keys.PublicKey
+	cfg.VAPIDPrivateKey = keys.PrivateKey
+	return nil
+}
+
+func writeVAPIDKeys(path string, keys *VAPIDKeys) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(keys)
+}
+
+func isURLSubscriber(subscriber string) bool {
+	return strings.HasPrefix(subscriber, "https://")
+}
+
+// webpush-go always signs the subscriber as a mailto: contact,
+// so the Authorization header is replaced for URL subscribers
+type vapidURLClient struct {
+	client     webpush.HTTPClient
+	subscriber string
+	publicKey  string
+	privateKey string
+}
+
+func (c *vapidURLClient) Do(req *http.Request) (*http.Response, error) {
+	privateKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(c.privateKey, "="))
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult(privateKey)
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		D:         new(big.Int).SetBytes(privateKey),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": fmt.Sprintf("%s://%s", req.URL.Scheme, req.URL.Host),
+		"exp": time.Now().Add(time.Hour * 12).Unix(),
+		"sub": c.subscriber,
+	})
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", signed, c.publicKey))
+	return c.client.Do(req)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Webhooks receive each message for a user with no open connection.
+// Requests are signed with the server's Ed25519 key, advertised in /info.
+// The X-Npchat-Signature header has the base64 signature of
+// "<X-Npchat-Timestamp>.<body>".
+type WebhookConfig struct {
+	KeyFile      string // generated if missing, random per start if empty
+	Workers      int
+	QueueSize    int
+	Retries      int
+	Backoff      Duration // doubled after each failed attempt
+	Timeout      Duration
+	AllowPrivate bool // allow loopback & private addresses, for testing
+}
+
+type webhookJob struct {
+	url     string
+	message []byte
+	attempt int
+}
+
+type WebhookQueue struct {
+	config     *WebhookConfig
+	jobs       chan webhookJob
+	client     *http.Client
+	privateKey ed25519.PrivateKey
+	publicKey  string
+}
+
+func newWebhookQueue(cfg *WebhookConfig) (*WebhookQueue, error) {
+	privateKey, err := loadWebhookKey(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	q := &WebhookQueue{
+		config:     cfg,
+		jobs:       make(chan webhookJob, cfg.QueueSize),
+		client:     newGuardedClient(cfg.Timeout.Duration, cfg.AllowPrivate),
+		privateKey: privateKey,
+		publicKey:  base64.RawURLEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go q.work()
+	}
+	return q, nil
+}
+
+// Key file holds the base64 seed of the private key
+func loadWebhookKey(path string) (ed25519.PrivateKey, error) {
+	if path != "" {
+		stored, err := os.ReadFile(path)
+		if err == nil {
+			seed, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(string(stored)))
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, errors.New("invalid webhook key file")
+			}
+			return ed25519.NewKeyFromSeed(seed), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		log.Println("no webhook key file defined, generated key will not survive restart")
+		return privateKey, nil
+	}
+	seed := base64.RawURLEncoding.EncodeToString(privateKey.Seed())
+	return privateKey, os.WriteFile(path, []byte(seed), 0600)
+}
+
+// Client for client-chosen URLs, like webhooks & push endpoints,
+// refusing private addresses unless allowed
+func newGuardedClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+	if !allowPrivate {
+		dialer.Control = denyPrivateAddress
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+	}
+}
+
+func denyPrivateAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return fmt.Errorf("address %v not allowed", host)
+	}
+	return nil
+}
+
+func isValidWebhookURL(url string) bool {
+	return url == "" || isHTTPEndpoint(url)
+}
+
+// Queue message without blocking, dropped if the queue is full
+func (q *WebhookQueue) enqueue(job webhookJob) {
+	select {
+	case q.jobs <- job:
+	default:
+		log.Println("webhook queue full, dropped message")
+	}
+}
+
+func (q *WebhookQueue) work() {
+	for job := range q.jobs {
+		err := q.deliver(&job)
+		if err == nil {
+			continue
+		}
+		if job.attempt >= q.config.Retries {
+			log.Println("failed to deliver webhook, giving up", err)
+			continue
+		}
+		backoff := q.config.Backoff.Duration << job.attempt
+		job.attempt++
+		retry := job
+		time.AfterFunc(backoff, func() {
+			q.enqueue(retry)
+		})
+	}
+}
+
+func (q *WebhookQueue) deliver(job *webhookJob) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signed := append([]byte(timestamp+"."), job.message...)
+	sig := ed25519.Sign(q.privateKey, signed)
+	ctx, cancel := context.WithTimeout(context.Background(), q.config.Timeout.Duration)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", job.url, bytes.NewReader(job.message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Npchat-Timestamp", timestamp)
+	req.Header.Set("X-Npchat-Signature", base64.RawURLEncoding.EncodeToString(sig))
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook replied %v", resp.Status)
+	}
+	return nil
+}
+
+// Get webhook URL, loading it from storage on first use.
+// Empty if none is set.
+func (u *User) getWebhook(kv *GobkvClient) string {
+	u.mux.RLock()
+	webhook := u.webhook
+	u.mux.RUnlock()
+	if webhook != nil {
+		return *webhook
+	}
+	stored, _ := kv.get(u.id + "/webhook")
+	url := string(stored)
+	u.mux.Lock()
+	u.webhook = &url
+	u.mux.Unlock()
+	return url
+}
+
+// Set webhook URL, or remove it if empty
+func (u *User) setWebhook(url string, kv *GobkvClient) error {
+	if !isValidWebhookURL(url) {
+		return newProtocolError(codeBadRequest, "webhook must be http(s)")
+	}
+	var err error
+	if url == "" {
+		err = kv.del(u.id + "/webhook")
+	} else {
+		err = kv.set(u.id+"/webhook", []byte(url))
+	}
+	if err != nil {
+		return err
+	}
+	u.mux.Lock()
+	u.webhook = &url
+	u.mux.Unlock()
+	return nil
+}
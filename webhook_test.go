@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testWebhookConfig() *WebhookConfig {
+	return &WebhookConfig{
+		Workers:      1,
+		QueueSize:    8,
+		Retries:      3,
+		Backoff:      Duration{time.Millisecond * time.Duration(20)},
+		Timeout:      Duration{time.Second},
+		AllowPrivate: true,
+	}
+}
+
+func TestWebhookDeliverySignedWithRetry(t *testing.T) {
+	var mux sync.Mutex
+	attempts := []time.Time{}
+	done := make(chan struct{})
+	var q *WebhookQueue
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Npchat-Timestamp")
+		sent, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+			t.Errorf("bad timestamp %q", timestamp)
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(r.Header.Get("X-Npchat-Signature"))
+		publicKey, _ := base64.RawURLEncoding.DecodeString(q.publicKey)
+		if !ed25519.Verify(publicKey, append([]byte(timestamp+"."), body...), sig) {
+			t.Error("signature does not verify")
+		}
+		if string(body) != "hello" {
+			t.Errorf("got body %q", body)
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		attempts = append(attempts, time.Now())
+		if len(attempts) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		close(done)
+	}))
+	defer receiver.Close()
+
+	cfg := testWebhookConfig()
+	q, err := newWebhookQueue(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.enqueue(webhookJob{
+		url:     receiver.URL,
+		message: []byte("hello"),
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * time.Duration(5)):
+		t.Fatal("webhook was not retried until delivered")
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	// backoff doubles after each attempt
+	for i := 1; i < len(attempts); i++ {
+		min := cfg.Backoff.Duration << (i - 1)
+		if gap := attempts[i].Sub(attempts[i-1]); gap < min {
+			t.Errorf("retry %v after %v, expected at least %v", i, gap, min)
+		}
+	}
+}
+
+func TestWebhookGivesUpAfterRetries(t *testing.T) {
+	var mux sync.Mutex
+	count := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		count++
+		mux.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer receiver.Close()
+
+	cfg := testWebhookConfig()
+	q, err := newWebhookQueue(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.enqueue(webhookJob{
+		url:     receiver.URL,
+		message: []byte("hello"),
+	})
+	time.Sleep(time.Millisecond * time.Duration(500))
+	mux.Lock()
+	defer mux.Unlock()
+	if count != cfg.Retries+1 {
+		t.Errorf("got %v attempts, expected %v", count, cfg.Retries+1)
+	}
+}
+
+func TestWebhookDeniesPrivateAddress(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("private address was reached")
+	}))
+	defer receiver.Close()
+
+	cfg := testWebhookConfig()
+	cfg.AllowPrivate = false
+	q, err := newWebhookQueue(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.deliver(&webhookJob{
+		url:     receiver.URL,
+		message: []byte("hello"),
+	})
+	if err == nil {
+		t.Error("expected delivery to loopback to fail")
+	}
+}